@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// principal is the verified identity behind an authenticated request
+type principal struct {
+	ZID       string
+	Scopes    []string
+	ExpiresAt time.Time
+}
+
+// authConfig holds the claims a token must carry to be accepted
+type authConfig struct {
+	// Issuer is the expected iss claim, ignored when empty
+	Issuer string
+	// Audience must be one of the aud claim values, ignored when empty
+	Audience string
+	// Leeway tolerates clock skew between this service and the auth service on exp, nbf and iat
+	Leeway time.Duration
+}
+
+// defaultLeeway is the clock skew tolerated when AUTH_LEEWAY is not set
+const defaultLeeway = 30 * time.Second
+
+func newAuthConfig() (authConfig, error) {
+	config := authConfig{
+		Issuer:   os.Getenv("AUTH_ISSUER"),
+		Audience: os.Getenv("AUTH_AUDIENCE"),
+		Leeway:   defaultLeeway,
+	}
+
+	if raw, ok := os.LookupEnv("AUTH_LEEWAY"); ok {
+		leeway, err := time.ParseDuration(raw)
+		if err != nil || leeway < 0 {
+			return config, errors.New("AUTH_LEEWAY must be a positive duration")
+		}
+		config.Leeway = leeway
+	}
+
+	return config, nil
+}
+
+// allowedAlgorithms are the only signing methods accepted, anything else is rejected before the signature is checked
+var allowedAlgorithms = map[string]bool{"RS256": true, "RS384": true, "RS512": true}
+
+// Reasons a token is rejected, each one is logged and sent as the problem detail
+var (
+	errTokenMalformed      = errors.New("Token is malformed")
+	errTokenAlgorithm      = errors.New("Token signing algorithm is not allowed")
+	errTokenUnknownKey     = errors.New("Token was signed by an unknown key")
+	errTokenSignature      = errors.New("Token signature is invalid")
+	errTokenMissingExpiry  = errors.New("Token has no exp claim")
+	errTokenExpired        = errors.New("Token has expired")
+	errTokenNotYetValid    = errors.New("Token is not valid yet")
+	errTokenIssuedInFuture = errors.New("Token was issued in the future")
+	errTokenIssuer         = errors.New("Token issuer is not accepted")
+	errTokenAudience       = errors.New("Token audience is not accepted")
+	errTokenMissingZID     = errors.New("Token has no zid claim")
+)
+
+var bearerRegex = regexp.MustCompile("^Bearer (.*)")
+
+// authenticate verifies the bearer token of every request it wraps and stores its principal in the context.
+// Requests without a valid token never reach the wrapped handler.
+func (s *server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matches := bearerRegex.FindStringSubmatch(r.Header.Get("Authorization"))
+		if len(matches) <= 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			s.writeProblem(w, r, problemMissingAuthorization, "Could not find a Bearer token in the Authorization header", nil)
+			return
+		}
+
+		user, err := s.verifyToken(matches[1])
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			s.writeProblem(w, r, problemInvalidToken, err.Error(), err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, user)))
+	})
+}
+
+// principalFrom returns the principal stored by authenticate, nil on unauthenticated requests
+func principalFrom(ctx context.Context) *principal {
+	user, _ := ctx.Value(principalKey).(*principal)
+	return user
+}
+
+// verifyToken checks the signature and the standard claims of a token, returning the reason it was rejected
+func (s *server) verifyToken(bearerToken string) (*principal, error) {
+	parser := jwt.Parser{SkipClaimsValidation: true}
+
+	token, err := parser.Parse(bearerToken, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok || !allowedAlgorithms[token.Method.Alg()] {
+			return nil, errTokenAlgorithm
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		key, err := s.keys.Key(kid)
+		if err != nil {
+			return nil, errTokenUnknownKey
+		}
+		return key, nil
+	})
+
+	if err != nil {
+		return nil, tokenErrorReason(err)
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errTokenSignature
+	}
+
+	return s.auth.verifyClaims(claims, jwt.TimeFunc())
+}
+
+func tokenErrorReason(err error) error {
+	validationErr, ok := err.(*jwt.ValidationError)
+	if !ok {
+		return errTokenMalformed
+	}
+
+	switch {
+	case validationErr.Inner == errTokenAlgorithm || validationErr.Inner == errTokenUnknownKey:
+		return validationErr.Inner
+	case validationErr.Errors&jwt.ValidationErrorMalformed != 0:
+		return errTokenMalformed
+	default:
+		return errTokenSignature
+	}
+}
+
+func (c *authConfig) verifyClaims(claims jwt.MapClaims, now time.Time) (*principal, error) {
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return nil, errTokenMissingExpiry
+	}
+	if now.After(exp.Add(c.Leeway)) {
+		return nil, errTokenExpired
+	}
+
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(c.Leeway).Before(nbf) {
+		return nil, errTokenNotYetValid
+	}
+
+	if iat, ok := numericClaim(claims, "iat"); ok && now.Add(c.Leeway).Before(iat) {
+		return nil, errTokenIssuedInFuture
+	}
+
+	if c.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != c.Issuer {
+			return nil, errTokenIssuer
+		}
+	}
+
+	if c.Audience != "" && !hasAudience(claims["aud"], c.Audience) {
+		return nil, errTokenAudience
+	}
+
+	zid, ok := claims["zid"].(string)
+	if !ok || zid == "" {
+		return nil, errTokenMissingZID
+	}
+
+	user := &principal{ZID: zid, ExpiresAt: exp}
+
+	if scopes, ok := claims["scopes"].([]interface{}); ok {
+		for _, scope := range scopes {
+			if name, ok := scope.(string); ok {
+				user.Scopes = append(user.Scopes, name)
+			}
+		}
+	}
+
+	return user, nil
+}
+
+// numericClaim reads a NumericDate claim, which the JSON decoder hands out as float64
+func numericClaim(claims jwt.MapClaims, name string) (time.Time, bool) {
+	value, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(value), 0), true
+}
+
+// hasAudience matches the aud claim, which may be a single string or a list of them
+func hasAudience(aud interface{}, expected string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == expected
+	case []interface{}:
+		for _, a := range aud {
+			if a == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
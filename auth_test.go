@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// getSignedMemoryServer is a memory backed server trusting the test signing key, so tests can mint any token
+func getSignedMemoryServer() *server {
+	s := getMemoryServer()
+	s.keys = newStaticKeyProvider(&getTestSigningKey().PublicKey)
+	return s
+}
+
+// validClaims are the claims of a token accepted by getSignedMemoryServer, for the given user
+func validClaims(zid string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"zid":    zid,
+		"scopes": []string{"user"},
+		"iat":    stubTokenTime.Add(-time.Minute).Unix(),
+		"exp":    stubTokenTime.Add(time.Hour).Unix(),
+	}
+}
+
+func authHeaderFor(t *testing.T, claims jwt.MapClaims) string {
+	return "Bearer " + signToken(t, getTestSigningKey(), "", claims)
+}
+
+func TestVerifyTokenRejections(t *testing.T) {
+	s := getSignedMemoryServer()
+	defer s.finalize()
+	s.auth = authConfig{Issuer: "https://trip-pin-points-auth.com", Audience: "markers", Leeway: 30 * time.Second}
+
+	signing := getTestSigningKey()
+	stranger, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	with := func(changes jwt.MapClaims) jwt.MapClaims {
+		claims := validClaims("string3")
+		claims["iss"] = "https://trip-pin-points-auth.com"
+		claims["aud"] = "markers"
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+
+	hmacWithPublicKey, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, with(nil)).SignedString(signing.PublicKey.N.Bytes())
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, with(nil)).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	ps256, _ := jwt.NewWithClaims(jwt.SigningMethodPS256, with(nil)).SignedString(signing)
+	rs512, _ := jwt.NewWithClaims(jwt.SigningMethodRS512, with(nil)).SignedString(signing)
+
+	tokens := []struct {
+		name   string
+		token  string
+		reason error
+	}{
+		{"valid", signToken(t, signing, "", with(nil)), nil},
+		{"rs512", rs512, nil},
+		{"audience list", signToken(t, signing, "", with(jwt.MapClaims{"aud": []string{"other", "markers"}})), nil},
+		{"expired within leeway", signToken(t, signing, "", with(jwt.MapClaims{"exp": stubTokenTime.Add(-10 * time.Second).Unix()})), nil},
+		{"garbage", "1234", errTokenMalformed},
+		{"hmac signed with the public key", hmacWithPublicKey, errTokenAlgorithm},
+		{"unsigned", unsigned, errTokenAlgorithm},
+		{"ps256", ps256, errTokenAlgorithm},
+		{"signed by another key", signToken(t, stranger, "", with(nil)), errTokenSignature},
+		{"no exp", signToken(t, signing, "", with(jwt.MapClaims{"exp": nil})), errTokenMissingExpiry},
+		{"expired", signToken(t, signing, "", with(jwt.MapClaims{"exp": stubTokenTime.Add(-time.Minute).Unix()})), errTokenExpired},
+		{"not before", signToken(t, signing, "", with(jwt.MapClaims{"nbf": stubTokenTime.Add(time.Minute).Unix()})), errTokenNotYetValid},
+		{"issued in the future", signToken(t, signing, "", with(jwt.MapClaims{"iat": stubTokenTime.Add(time.Minute).Unix()})), errTokenIssuedInFuture},
+		{"other issuer", signToken(t, signing, "", with(jwt.MapClaims{"iss": "https://evil.example.com"})), errTokenIssuer},
+		{"no audience", signToken(t, signing, "", with(jwt.MapClaims{"aud": nil})), errTokenAudience},
+		{"other audience", signToken(t, signing, "", with(jwt.MapClaims{"aud": "billing"})), errTokenAudience},
+		{"no zid", signToken(t, signing, "", with(jwt.MapClaims{"zid": nil})), errTokenMissingZID},
+		{"numeric zid", signToken(t, signing, "", with(jwt.MapClaims{"zid": 42})), errTokenMissingZID},
+		{"empty zid", signToken(t, signing, "", with(jwt.MapClaims{"zid": ""})), errTokenMissingZID},
+	}
+
+	for _, tt := range tokens {
+		user, err := s.verifyToken(tt.token)
+		assert.Equal(t, tt.reason, err, tt.name)
+		if tt.reason == nil {
+			assert.Equal(t, "string3", user.ZID, tt.name)
+		}
+	}
+}
+
+func TestAuthenticateAnswersRejectionReason(t *testing.T) {
+	s := getSignedMemoryServer()
+	defer s.finalize()
+
+	claims := validClaims("string3")
+	claims["exp"] = stubTokenTime.Add(-time.Hour).Unix()
+
+	req, _ := http.NewRequest("GET", "/marker", nil)
+	req.Header.Set("Authorization", authHeaderFor(t, claims))
+	req.Header.Set("X-Request-ID", "test-request")
+	res := httptest.NewRecorder()
+	s.router.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+	assert.Equal(t, `Bearer error="invalid_token"`, res.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, `{"type":"https://trip-pin-points-markers.com/problems/invalid-token","title":"Invalid token","status":401,"detail":"Token has expired","instance":"/marker","request_id":"test-request"}`, res.Body.String())
+}
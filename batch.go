@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// maxBatchOperations bounds the number of operations of a single batch
+const maxBatchOperations = 100
+
+// Modes of a batch, an atomic batch applies every operation or none of them
+const (
+	batchAtomic     = "atomic"
+	batchBestEffort = "best_effort"
+)
+
+// batchResult tells what became of one operation of a batch, Status is the one its own request would have answered
+type batchResult struct {
+	Index  int          `json:"index"`
+	Op     string       `json:"op"`
+	Status int          `json:"status"`
+	Marker *Marker      `json:"marker,omitempty"`
+	Detail string       `json:"detail,omitempty"`
+	Errors []fieldError `json:"errors,omitempty"`
+}
+
+// batchResponse answers a batch, Committed is false when an atomic batch was rolled back
+type batchResponse struct {
+	Committed bool          `json:"committed"`
+	Results   []batchResult `json:"results"`
+}
+
+// batchRequest is a parsed batch, operations that failed validation are only in results
+type batchRequest struct {
+	atomic     bool
+	operations []BatchOperation
+	// indexes maps every operation to its position in the request
+	indexes []int
+	results []batchResult
+}
+
+func getBatchRequest(body io.Reader, user string) (*batchRequest, error) {
+
+	fields, err := decodeObject(body)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := &validationError{}
+	batch := &batchRequest{atomic: true}
+
+	if value, ok := fields["mode"]; ok {
+		var mode string
+		json.Unmarshal(value, &mode)
+		switch mode {
+		case batchAtomic:
+		case batchBestEffort:
+			batch.atomic = false
+		default:
+			errs.add("mode", "must be atomic or best_effort")
+		}
+	}
+
+	var operations []json.RawMessage
+	if value, ok := fields["operations"]; !ok {
+		errs.add("operations", "is required")
+	} else if err = json.Unmarshal(value, &operations); err != nil || operations == nil {
+		errs.add("operations", "must be a list of operations")
+	} else if len(operations) == 0 {
+		errs.add("operations", "must not be empty")
+	} else if len(operations) > maxBatchOperations {
+		errs.add("operations", fmt.Sprintf("must not have more than %d operations", maxBatchOperations))
+	}
+
+	if err = errs.orNil(); err != nil {
+		return nil, err
+	}
+
+	batch.results = make([]batchResult, len(operations))
+	for i, raw := range operations {
+		batch.results[i].Index = i
+		operation, invalid := getBatchOperation(raw, user, &batch.results[i])
+		if invalid != nil {
+			batch.results[i].Status = http.StatusBadRequest
+			batch.results[i].Detail = invalid.Error()
+			batch.results[i].Errors = invalid.Fields
+			continue
+		}
+		batch.operations = append(batch.operations, *operation)
+		batch.indexes = append(batch.indexes, i)
+	}
+
+	return batch, nil
+}
+
+// getBatchOperation validates one operation, whose marker fields follow the rules of a single marker request
+func getBatchOperation(raw json.RawMessage, user string, result *batchResult) (*BatchOperation, *validationError) {
+	errs := &validationError{}
+
+	var operation struct {
+		Op     string          `json:"op"`
+		ID     *int64          `json:"id"`
+		Marker json.RawMessage `json:"marker"`
+	}
+	if err := json.Unmarshal(raw, &operation); err != nil {
+		errs.add("operation", "must be an object with op, id and marker")
+		return nil, errs
+	}
+	result.Op = operation.Op
+
+	switch operation.Op {
+	case batchCreate, batchUpdate, batchDelete:
+	default:
+		errs.add("op", "must be create, update or delete")
+		return nil, errs
+	}
+
+	marker := &Marker{User: user}
+
+	if operation.Op != batchDelete {
+		if operation.Marker == nil {
+			errs.add("marker", "is required")
+		} else if parsed, err := getNewMarker(bytes.NewReader(operation.Marker), user); err != nil {
+			if invalid, ok := err.(*validationError); ok {
+				for _, field := range invalid.Fields {
+					errs.add("marker."+field.Field, field.Reason)
+				}
+			} else {
+				errs.add("marker", "must be a JSON object")
+			}
+		} else {
+			marker = parsed
+		}
+	}
+
+	if operation.Op != batchCreate {
+		if operation.ID == nil {
+			errs.add("id", "is required")
+		} else {
+			marker.ID = *operation.ID
+		}
+	}
+
+	if len(errs.Fields) > 0 {
+		return nil, errs
+	}
+	return &BatchOperation{Kind: operation.Op, Marker: marker}, nil
+}
+
+// handleBatch applies many marker changes in a single transaction, see batchResponse for the answer
+func (s *server) handleBatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		batch, err := getBatchRequest(http.MaxBytesReader(w, r.Body, maxImportSize), userZid)
+		if err != nil {
+			s.writeBodyError(w, r, err)
+			return
+		}
+
+		response := batchResponse{Committed: true, Results: batch.results}
+		invalid := len(batch.operations) < len(batch.results)
+
+		var outcomes []error
+		if len(batch.operations) > 0 && !(batch.atomic && invalid) {
+			if outcomes, err = s.store.Batch(batch.operations, batch.atomic); err != nil {
+				s.writeStoreError(w, r, err, "")
+				return
+			}
+		}
+
+		failed := false
+		for i, outcome := range outcomes {
+			result := &response.Results[batch.indexes[i]]
+			operation := batch.operations[i]
+
+			switch {
+			case outcome == errMarkerNotFound:
+				result.Status = http.StatusNotFound
+				result.Detail = "Could not find marker"
+				failed = true
+			case outcome != nil:
+				s.logger.Error("Could not apply batch operation", zap.Int("index", batch.indexes[i]), zap.Error(outcome))
+				result.Status = http.StatusInternalServerError
+				result.Detail = problemStorage.title
+				failed = true
+			case operation.Kind == batchCreate:
+				result.Status = http.StatusCreated
+				result.Marker = operation.Marker
+			case operation.Kind == batchUpdate:
+				result.Status = http.StatusOK
+				result.Marker = operation.Marker
+			default:
+				result.Status = http.StatusNoContent
+			}
+		}
+
+		if batch.atomic && (invalid || failed) {
+			response.Committed = false
+			for i := range response.Results {
+				if result := &response.Results[i]; result.Status < http.StatusBadRequest {
+					*result = batchResult{Index: i, Op: result.Op, Status: http.StatusFailedDependency, Detail: "Not applied because another operation of the batch failed"}
+				}
+			}
+		}
+
+		writeJSON(w, http.StatusOK, response)
+	}
+}
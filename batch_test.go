@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryAtomicBatch(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	s.store.Insert(&Marker{User: "string3", Lat: 1, Lng: 1, Note: "old"})
+	s.store.Insert(&Marker{User: "string3", Lat: 2, Lng: 2, Note: "gone"})
+
+	res := serveAs(s, "POST", "/marker/batch", `{"operations":[
+		{"op":"create","marker":{"lat":3,"lng":3,"note":"new"}},
+		{"op":"update","id":1,"marker":{"lat":1,"lng":1,"note":"edited"}},
+		{"op":"delete","id":2}
+	]}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"committed":true,"results":[`+
+		`{"index":0,"op":"create","status":201,"marker":{"id":3,"user":"string3","lat":3,"lng":3,"note":"new","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}},`+
+		`{"index":1,"op":"update","status":200,"marker":{"id":1,"user":"string3","lat":1,"lng":1,"note":"edited","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}},`+
+		`{"index":2,"op":"delete","status":204}]}`, res.Body.String())
+
+	res = serveAs(s, "POST", "/marker/batch", `{"mode":"atomic","operations":[
+		{"op":"delete","id":1},
+		{"op":"update","id":2,"marker":{"lat":2,"lng":2}},
+		{"op":"create","marker":{"lat":4,"lng":4}}
+	]}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"committed":false,"results":[`+
+		`{"index":0,"op":"delete","status":424,"detail":"Not applied because another operation of the batch failed"},`+
+		`{"index":1,"op":"update","status":404,"detail":"Could not find marker"},`+
+		`{"index":2,"op":"create","status":424,"detail":"Not applied because another operation of the batch failed"}]}`, res.Body.String())
+
+	markers, _ := s.store.List("string3", MarkerFilter{})
+	assert.Equal(t, []Marker{
+		{ID: 1, User: "string3", Lat: 1, Lng: 1, Note: "edited", Visibility: "members", CreatedAt: stubMarkerTime, UpdatedAt: stubMarkerTime},
+		{ID: 3, User: "string3", Lat: 3, Lng: 3, Note: "new", Visibility: "members", CreatedAt: stubMarkerTime, UpdatedAt: stubMarkerTime},
+	}, markers.Markers)
+}
+
+func TestMemoryBestEffortBatch(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	s.store.Insert(&Marker{User: "string3", Lat: 1, Lng: 1})
+	s.store.Insert(&Marker{User: "someone-else", Lat: 2, Lng: 2})
+
+	res := serveAs(s, "POST", "/marker/batch", `{"mode":"best_effort","operations":[
+		{"op":"delete","id":2},
+		{"op":"create","marker":{"lat":95,"lng":3}},
+		{"op":"move","id":1},
+		{"op":"update","marker":{"lat":1}},
+		{"op":"create","marker":{"lat":4,"lng":4}}
+	]}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"committed":true,"results":[`+
+		`{"index":0,"op":"delete","status":404,"detail":"Could not find marker"},`+
+		`{"index":1,"op":"create","status":400,"detail":"Invalid fields: marker.lat must be between -90 and 90","errors":[{"field":"marker.lat","reason":"must be between -90 and 90"}]},`+
+		`{"index":2,"op":"move","status":400,"detail":"Invalid fields: op must be create, update or delete","errors":[{"field":"op","reason":"must be create, update or delete"}]},`+
+		`{"index":3,"op":"update","status":400,"detail":"Invalid fields: marker.lng is required, id is required","errors":[{"field":"marker.lng","reason":"is required"},{"field":"id","reason":"is required"}]},`+
+		`{"index":4,"op":"create","status":201,"marker":{"id":3,"user":"string3","lat":4,"lng":4,"note":"","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}}]}`, res.Body.String())
+
+	other, _ := s.store.Get("someone-else", 2)
+	assert.NotNil(t, other)
+}
+
+func TestInvalidBatch(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	tooMany := `{"operations":[` + strings.Repeat(`{"op":"delete","id":1},`, maxBatchOperations) + `{"op":"delete","id":1}]}`
+
+	bodies := []struct {
+		body   string
+		kind   problemType
+		errors []fieldError
+	}{
+		{`[]`, problemInvalidBody, nil},
+		{`{"mode":"eventually"}`, problemValidation, []fieldError{{"mode", "must be atomic or best_effort"}, {"operations", "is required"}}},
+		{`{"operations":[]}`, problemValidation, []fieldError{{"operations", "must not be empty"}}},
+		{`{"operations":{"op":"delete"}}`, problemValidation, []fieldError{{"operations", "must be a list of operations"}}},
+		{tooMany, problemValidation, []fieldError{{"operations", "must not have more than 100 operations"}}},
+	}
+
+	for _, tt := range bodies {
+		res := serveAs(s, "POST", "/marker/batch", tt.body)
+		assertProblem(t, res, tt.kind, tt.errors...)
+	}
+}
+
+func TestBatchRunsInOneTransaction(t *testing.T) {
+	s, mock := getMockServer()
+	defer s.finalize()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO markers").
+		WithArgs("string3", 3.0, 3.0, "", nil, nil, "members").
+		WillReturnRows(insertedRow(9))
+	mock.ExpectExec(`UPDATE markers\s+SET deleted_at=now\(\)`).
+		WithArgs("string3", 5).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	res := serveAs(s, "POST", "/marker/batch", `{"operations":[{"op":"create","marker":{"lat":3,"lng":3}},{"op":"delete","id":5},{"op":"delete","id":6}]}`)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Contains(t, res.Body.String(), `"committed":false`)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`SAVEPOINT op_0`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`UPDATE markers\s+SET deleted_at=now\(\)`).
+		WithArgs("string3", 5).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`SAVEPOINT op_1`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`UPDATE markers\s+SET deleted_at=now\(\)`).
+		WithArgs("string3", 6).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	res = serveAs(s, "POST", "/marker/batch", `{"mode":"best_effort","operations":[{"op":"delete","id":5},{"op":"delete","id":6}]}`)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, `{"committed":true,"results":[{"index":0,"op":"delete","status":404,"detail":"Could not find marker"},{"index":1,"op":"delete","status":204}]}`, res.Body.String())
+}
+
+func TestBestEffortBatchSurvivesFailingOperation(t *testing.T) {
+	s, mock := getMockServer()
+	defer s.finalize()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`SAVEPOINT op_0`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("INSERT INTO markers").
+		WithArgs("string3", 3.0, 3.0, "", nil, nil, "members").
+		WillReturnError(errors.New("test error"))
+	mock.ExpectExec(`ROLLBACK TO SAVEPOINT op_0`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`SAVEPOINT op_1`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`UPDATE markers\s+SET deleted_at=now\(\)`).
+		WithArgs("string3", 6).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	res := serveAs(s, "POST", "/marker/batch", `{"mode":"best_effort","operations":[{"op":"create","marker":{"lat":3,"lng":3}},{"op":"delete","id":6}]}`)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, `{"committed":true,"results":[{"index":0,"op":"create","status":500,"detail":"Could not access the marker storage"},{"index":1,"op":"delete","status":204}]}`, res.Body.String())
+}
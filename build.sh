@@ -3,6 +3,7 @@ go get github.com/rs/cors
 go get github.com/dgrijalva/jwt-go
 go get github.com/lib/pq
 go get go.uber.org/zap
+go get golang.org/x/crypto/bcrypt
 go get github.com/DATA-DOG/go-sqlmock
 go get github.com/stretchr/testify
 
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// csvMapping tells which column of a CSV file holds each marker field
+type csvMapping struct {
+	columns   map[string]string
+	indexes   map[string]int
+	delimiter rune
+}
+
+// getCSVMapping reads the mapping query, written as field:Column pairs such as lat:Latitude,lng:Longitude,note:Name.
+// Without it the columns are expected to be named after the fields.
+func getCSVMapping(values url.Values) (*csvMapping, error) {
+	mapping := &csvMapping{columns: map[string]string{}, delimiter: ','}
+	for _, field := range markerFields {
+		mapping.columns[field] = field
+	}
+
+	if raw := values.Get("mapping"); raw != "" {
+		for _, pair := range strings.Split(raw, ",") {
+			parts := strings.SplitN(pair, ":", 2)
+			if len(parts) != 2 || !isMarkerField(parts[0]) || strings.TrimSpace(parts[1]) == "" {
+				return nil, fmt.Errorf("mapping must be field:Column pairs where field is one of %s", strings.Join(markerFields, ", "))
+			}
+			mapping.columns[parts[0]] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	if raw := values.Get("delimiter"); raw != "" {
+		delimiter, size := utf8.DecodeRuneInString(raw)
+		if size != len(raw) || delimiter == '"' || delimiter == '\r' || delimiter == '\n' {
+			return nil, errors.New("delimiter must be a single character")
+		}
+		mapping.delimiter = delimiter
+	}
+
+	return mapping, nil
+}
+
+func isMarkerField(name string) bool {
+	for _, field := range markerFields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// locate finds the mapped columns in the header row, the note, visited_at and visibility columns are optional
+func (m *csvMapping) locate(header []string) error {
+	m.indexes = map[string]int{}
+
+	for field, column := range m.columns {
+		for i, name := range header {
+			if strings.EqualFold(strings.TrimSpace(name), column) {
+				m.indexes[field] = i
+				break
+			}
+		}
+	}
+
+	for _, field := range []string{"lat", "lng"} {
+		if _, ok := m.indexes[field]; !ok {
+			return fmt.Errorf("CSV header has no %s column for %s", m.columns[field], field)
+		}
+	}
+	return nil
+}
+
+// marker validates one row with the same rules as a marker sent as JSON
+func (m *csvMapping) marker(row []string, user string) (*Marker, *validationError) {
+	marker := Marker{User: user}
+	errs := &validationError{}
+
+	for _, field := range markerFields {
+		index, ok := m.indexes[field]
+		cell := ""
+		if ok && index < len(row) {
+			cell = strings.TrimSpace(row[index])
+		}
+
+		switch {
+		case field == "note":
+			marker.Note = unquoteFormula(cell)
+		case cell == "" && (field == "visited_at" || field == "visibility"):
+		case cell == "":
+			errs.add(field, "is required")
+		case field == "visited_at" || field == "visibility":
+			setMarkerField(&marker, field, json.RawMessage(strconv.Quote(cell)), errs)
+		default:
+			setMarkerField(&marker, field, json.RawMessage(cell), errs)
+		}
+	}
+
+	if len(errs.Fields) > 0 {
+		return nil, errs
+	}
+	return &marker, nil
+}
+
+// formulaPrefixes are the characters a spreadsheet cell starts with to be run as a formula
+const formulaPrefixes = "=+-@\t\r"
+
+// isFormula tells whether a spreadsheet would run note as a formula once the quotes it starts with are removed
+func isFormula(note string) bool {
+	unquoted := strings.TrimLeft(note, "'")
+	return unquoted != "" && strings.IndexByte(formulaPrefixes, unquoted[0]) >= 0
+}
+
+// quoteFormula prefixes notes a spreadsheet would run as a formula with a quote, which makes them plain text
+func quoteFormula(note string) string {
+	if isFormula(note) {
+		return "'" + note
+	}
+	return note
+}
+
+// unquoteFormula removes the quote quoteFormula added, so exported notes import back as they were
+func unquoteFormula(note string) string {
+	if strings.HasPrefix(note, "'") && isFormula(note[1:]) {
+		return note[1:]
+	}
+	return note
+}
+
+// csvRowReport tells what became of one data row of an imported CSV, rows are counted from 1 after the header
+type csvRowReport struct {
+	Row    int          `json:"row"`
+	Status string       `json:"status"`
+	Marker *Marker      `json:"marker,omitempty"`
+	Errors []fieldError `json:"errors,omitempty"`
+}
+
+// csvImportReport is the answer to a CSV import, valid rows are saved even when others are rejected
+type csvImportReport struct {
+	Accepted int            `json:"accepted"`
+	Rejected int            `json:"rejected"`
+	Rows     []csvRowReport `json:"rows"`
+}
+
+// readCSV reads every data row of a CSV file, its header must hold the mapped columns
+func readCSV(body io.Reader, mapping *csvMapping) ([][]string, error) {
+	reader := csv.NewReader(body)
+	reader.Comma = mapping.delimiter
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("CSV has no header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = mapping.locate(header); err != nil {
+		return nil, err
+	}
+
+	var rows [][]string
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == maxImportMarkers {
+			return nil, fmt.Errorf("CSV must not have more than %d rows", maxImportMarkers)
+		}
+		rows = append(rows, row)
+	}
+}
+
+func (s *server) handleImportCSV() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		mapping, err := getCSVMapping(r.URL.Query())
+		if err != nil {
+			s.writeProblem(w, r, problemInvalidQuery, err.Error(), err)
+			return
+		}
+
+		rows, err := readCSV(http.MaxBytesReader(w, r.Body, maxImportSize), mapping)
+		if err != nil {
+			s.writeProblem(w, r, problemInvalidBody, err.Error(), err)
+			return
+		}
+
+		report := csvImportReport{Rows: make([]csvRowReport, len(rows))}
+		var operations []BatchOperation
+		var accepted []int
+
+		for i, row := range rows {
+			report.Rows[i].Row = i + 1
+
+			marker, invalid := mapping.marker(row, userZid)
+			if invalid != nil {
+				report.Rows[i].Status = "rejected"
+				report.Rows[i].Errors = invalid.Fields
+				report.Rejected++
+				continue
+			}
+			operations = append(operations, BatchOperation{Kind: batchCreate, Marker: marker})
+			accepted = append(accepted, i)
+		}
+
+		if _, err = s.store.Batch(operations, true); err != nil {
+			s.writeStoreError(w, r, err, "")
+			return
+		}
+
+		for j, i := range accepted {
+			report.Rows[i].Status = "accepted"
+			report.Rows[i].Marker = operations[j].Marker
+			report.Accepted++
+		}
+
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// csvHeader are the columns of an exported CSV, which imports back without a mapping
+var csvHeader = []string{"id", "lat", "lng", "note", "visited_at", "visibility"}
+
+// writeCSV streams markers as CSV rows, with notes quoted so spreadsheets do not run them as formulas
+func writeCSV(w io.Writer, source *exportSource) error {
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+
+	err := source.each(func(m *Marker) error {
+		visitedAt := ""
+		if m.VisitedAt != nil {
+			visitedAt = m.VisitedAt.Format(time.RFC3339)
+		}
+		return writer.Write([]string{
+			strconv.FormatInt(m.ID, 10),
+			formatCoordinate(m.Lat),
+			formatCoordinate(m.Lng),
+			quoteFormula(m.Note),
+			visitedAt,
+			m.Visibility,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func (s *server) handleExportCSV() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		tripID, err := getExportTrip(r.URL.Query())
+		if err != nil {
+			s.writeProblem(w, r, problemInvalidQuery, err.Error(), err)
+			return
+		}
+
+		source, err := s.openExport(userZid, tripID)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		writeAttachment(w, "text/csv; charset=utf-8", "markers.csv")
+		if err = writeCSV(w, source); err != nil {
+			s.logger.Info("Could not write CSV export", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryImportCSV(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	body := "Partner;Latitude;Longitude\n" +
+		"Harbour office;38.7;-9.1\n" +
+		"\"Depot; north\";91;-9.1\n" +
+		"Nowhere;;abc\n" +
+		"Short row;1.5\n" +
+		"Yard;0;0\n"
+
+	res := serveAs(s, "POST", "/import/csv?delimiter=%3B&mapping=lat:latitude,lng:Longitude,note:Partner", body)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"accepted":2,"rejected":3,"rows":[`+
+		`{"row":1,"status":"accepted","marker":{"id":1,"user":"string3","lat":38.7,"lng":-9.1,"note":"Harbour office","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}},`+
+		`{"row":2,"status":"rejected","errors":[{"field":"lat","reason":"must be between -90 and 90"}]},`+
+		`{"row":3,"status":"rejected","errors":[{"field":"lat","reason":"is required"},{"field":"lng","reason":"must be a number"}]},`+
+		`{"row":4,"status":"rejected","errors":[{"field":"lng","reason":"is required"}]},`+
+		`{"row":5,"status":"accepted","marker":{"id":2,"user":"string3","lat":0,"lng":0,"note":"Yard","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}}]}`, res.Body.String())
+}
+
+func TestImportCSVRollsBackOnFailure(t *testing.T) {
+	s, mock := getMockServer()
+	defer s.finalize()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO markers").
+		WithArgs("string3", 38.7, -9.1, "", nil, nil, "members").
+		WillReturnRows(insertedRow(1))
+	mock.ExpectQuery("INSERT INTO markers").
+		WithArgs("string3", 0.0, 0.0, "", nil, nil, "members").
+		WillReturnError(errors.New("test error"))
+	mock.ExpectRollback()
+
+	res := serveAs(s, "POST", "/import/csv", "lat,lng\n38.7,-9.1\n91,0\n0,0\n")
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assertProblem(t, res, problemStorage)
+}
+
+func TestMemoryImportInvalidCSV(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	requests := []struct {
+		url  string
+		body string
+		kind problemType
+	}{
+		{"/import/csv?mapping=latitude", "lat,lng\n1,2\n", problemInvalidQuery},
+		{"/import/csv?mapping=height:Alt", "lat,lng\n1,2\n", problemInvalidQuery},
+		{"/import/csv?delimiter=ab", "lat,lng\n1,2\n", problemInvalidQuery},
+		{"/import/csv", "", problemInvalidBody},
+		{"/import/csv", "latitude,lng\n1,2\n", problemInvalidBody},
+		{"/import/csv", "lat,lng\n1,\"2\n", problemInvalidBody},
+	}
+
+	for _, tt := range requests {
+		res := serveAs(s, "POST", tt.url, tt.body)
+		assertProblem(t, res, tt.kind)
+	}
+
+	markers, _ := s.store.List("string3", MarkerFilter{})
+	assert.Empty(t, markers.Markers)
+}
+
+func TestMemoryExportCSV(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	visitedAt := time.Date(2019, time.March, 2, 9, 30, 0, 0, time.FixedZone("", -3*60*60))
+	s.store.Insert(&Marker{User: "string3", Lat: 38.7, Lng: -9.1, Note: "Harbour office", Visibility: "members", VisitedAt: &visitedAt})
+	s.store.Insert(&Marker{User: "string3", Lat: 0, Lng: 0, Note: "Yard, \"south\" gate"})
+	s.store.Insert(&Marker{User: "string3", Lat: 1, Lng: 1, Note: "=HYPERLINK(\"http://example.com\")"})
+	s.store.Insert(&Marker{User: "string3", Lat: 2, Lng: 2, Note: "'-2 floors"})
+
+	res := serveAs(s, "GET", "/export/csv", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", res.Header().Get("Content-Type"))
+	assert.Equal(t, "id,lat,lng,note,visited_at,visibility\n1,38.7,-9.1,Harbour office,2019-03-02T09:30:00-03:00,members\n2,0,0,\"Yard, \"\"south\"\" gate\",,members\n"+
+		"3,1,1,\"'=HYPERLINK(\"\"http://example.com\"\")\",,members\n4,2,2,''-2 floors,,members\n", res.Body.String())
+
+	exported := res.Body.String()
+	s = getMemoryServer()
+	defer s.finalize()
+
+	res = serveAs(s, "POST", "/import/csv", exported)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	markers, _ := s.store.List("string3", MarkerFilter{})
+	assert.Equal(t, []Marker{
+		{ID: 1, User: "string3", Lat: 38.7, Lng: -9.1, Note: "Harbour office", Visibility: "members", VisitedAt: &visitedAt, CreatedAt: stubMarkerTime, UpdatedAt: stubMarkerTime},
+		{ID: 2, User: "string3", Lat: 0, Lng: 0, Note: "Yard, \"south\" gate", Visibility: "members", CreatedAt: stubMarkerTime, UpdatedAt: stubMarkerTime},
+		{ID: 3, User: "string3", Lat: 1, Lng: 1, Note: "=HYPERLINK(\"http://example.com\")", Visibility: "members", CreatedAt: stubMarkerTime, UpdatedAt: stubMarkerTime},
+		{ID: 4, User: "string3", Lat: 2, Lng: 2, Note: "'-2 floors", Visibility: "members", CreatedAt: stubMarkerTime, UpdatedAt: stubMarkerTime},
+	}, markers.Markers)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// maxImportSize bounds the body of an import, in bytes
+const maxImportSize = 10 << 20
+
+// maxImportMarkers bounds the number of markers a single import can create
+const maxImportMarkers = 10000
+
+// exportSource streams the markers of an export, either every marker of the user or the markers of one trip
+type exportSource struct {
+	// Name titles the exported document
+	Name string
+
+	page []Marker
+	// next fetches the page following the current one, nil when there is none
+	next func() ([]Marker, error)
+}
+
+// getExportTrip reads the trip query of an export, zero exports every marker
+func getExportTrip(values url.Values) (int64, error) {
+	raw := values.Get("trip")
+	if raw == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("trip must be a trip id")
+	}
+	return id, nil
+}
+
+// openExport prepares the export of a trip, or of every marker of user when tripID is zero.
+// The first page is read right away so a failing store is reported before the export starts.
+func (s *server) openExport(user string, tripID int64) (*exportSource, error) {
+	if tripID != 0 {
+		access, err := s.tripAccess(user, tripID, roleViewer)
+		if err != nil {
+			return nil, err
+		}
+		trip, err := s.tripWithMarkers(access.Creator, tripID, user)
+		if err != nil {
+			return nil, err
+		}
+		return &exportSource{Name: trip.Name, page: trip.Markers}, nil
+	}
+
+	source := &exportSource{Name: "Markers of " + user}
+	filter := MarkerFilter{Limit: maxPageSize}
+
+	source.next = func() ([]Marker, error) {
+		page, err := s.store.List(user, filter)
+		if err != nil {
+			return nil, err
+		}
+		if page.NextCursor == "" {
+			source.next = nil
+		} else {
+			filter.After = &markerCursor{ID: page.Markers[len(page.Markers)-1].ID}
+		}
+		return page.Markers, nil
+	}
+
+	var err error
+	if source.page, err = source.next(); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// each calls write with every exported marker, fetching the following pages as needed
+func (e *exportSource) each(write func(m *Marker) error) error {
+	for {
+		for i := range e.page {
+			if err := write(&e.page[i]); err != nil {
+				return err
+			}
+		}
+
+		if e.next == nil {
+			return nil
+		}
+
+		var err error
+		if e.page, err = e.next(); err != nil {
+			return err
+		}
+	}
+}
+
+// validateImported checks every imported marker, reporting them by their position in the import
+func validateImported(markers []Marker) error {
+	errs := &validationError{}
+
+	if len(markers) > maxImportMarkers {
+		errs.add("markers", fmt.Sprintf("must not be more than %d", maxImportMarkers))
+		return errs
+	}
+
+	for i := range markers {
+		if invalid, ok := validateMarker(&markers[i]).(*validationError); ok {
+			for _, field := range invalid.Fields {
+				errs.add(fmt.Sprintf("markers[%d].%s", i, field.Field), field.Reason)
+			}
+		}
+	}
+	return errs.orNil()
+}
+
+// insertImported validates every imported marker, then saves them all in a single transaction
+func (s *server) insertImported(markers []Marker) (*MarkerCollection, error) {
+	if err := validateImported(markers); err != nil {
+		return nil, err
+	}
+
+	operations := make([]BatchOperation, len(markers))
+	for i := range markers {
+		operations[i] = BatchOperation{Kind: batchCreate, Marker: &markers[i]}
+	}
+	if _, err := s.store.Batch(operations, true); err != nil {
+		return nil, err
+	}
+
+	return &MarkerCollection{Markers: append([]Marker{}, markers...)}, nil
+}
+
+// writeImportError answers a failed import, telling invalid markers apart from a storage failure
+func (s *server) writeImportError(w http.ResponseWriter, r *http.Request, err error) {
+	if _, ok := err.(*validationError); ok {
+		s.writeBodyError(w, r, err)
+		return
+	}
+	s.writeStoreError(w, r, err, "")
+}
+
+// writeAttachment answers with a file the client should save as filename
+func writeAttachment(w http.ResponseWriter, contentType string, filename string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// earthRadius is the mean radius of the earth in meters
+const earthRadius = 6371008.8
+
+// BoundingBox is a rectangular map viewport.
+// When MinLng is greater than MaxLng the box crosses the antimeridian.
+type BoundingBox struct {
+	MinLng float64
+	MinLat float64
+	MaxLng float64
+	MaxLat float64
+}
+
+// parseBoundingBox reads a box in the minLng,minLat,maxLng,maxLat format
+func parseBoundingBox(raw string) (*BoundingBox, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != 4 {
+		return nil, errors.New("bbox must be minLng,minLat,maxLng,maxLat")
+	}
+
+	var values [4]float64
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, errors.New("bbox must only contain numbers")
+		}
+		values[i] = value
+	}
+
+	box := &BoundingBox{MinLng: values[0], MinLat: values[1], MaxLng: values[2], MaxLat: values[3]}
+
+	if box.MinLat > box.MaxLat {
+		return nil, errors.New("bbox minLat must not be greater than maxLat")
+	}
+	if box.MinLat < -90 || box.MaxLat > 90 {
+		return nil, errors.New("bbox latitudes must be between -90 and 90")
+	}
+	if box.MinLng < -180 || box.MinLng > 180 || box.MaxLng < -180 || box.MaxLng > 180 {
+		return nil, errors.New("bbox longitudes must be between -180 and 180")
+	}
+
+	return box, nil
+}
+
+// crossesAntimeridian tells if the box wraps around longitude 180
+func (b *BoundingBox) crossesAntimeridian() bool {
+	return b.MinLng > b.MaxLng
+}
+
+func (b *BoundingBox) contains(lat float64, lng float64) bool {
+	if lat < b.MinLat || lat > b.MaxLat {
+		return false
+	}
+	if b.crossesAntimeridian() {
+		return lng >= b.MinLng || lng <= b.MaxLng
+	}
+	return lng >= b.MinLng && lng <= b.MaxLng
+}
+
+// haversine returns the great-circle distance in meters between two coordinates
+func haversine(lat1 float64, lng1 float64, lat2 float64, lng2 float64) float64 {
+	dLat := toRadians(lat2 - lat1)
+	dLng := toRadians(lng2 - lng1)
+
+	a := math.Pow(math.Sin(dLat/2), 2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Pow(math.Sin(dLng/2), 2)
+
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// latitudeSpan is how many degrees of latitude a distance in meters covers
+func latitudeSpan(meters float64) float64 {
+	return meters / earthRadius * 180 / math.Pi
+}
+
+func toRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBoundingBox(t *testing.T) {
+	box, err := parseBoundingBox("-10.5,20,30,40.25")
+	assert.NoError(t, err)
+	assert.Equal(t, &BoundingBox{MinLng: -10.5, MinLat: 20, MaxLng: 30, MaxLat: 40.25}, box)
+
+	for _, raw := range []string{"", "1,2,3", "a,2,3,4", "1,50,3,40", "1,-91,3,4", "1,2,181,4", "NaN,2,3,4", "1,2,3,NaN", "-Inf,2,3,4", "1,2,+Inf,4"} {
+		_, err := parseBoundingBox(raw)
+		assert.Error(t, err, raw)
+	}
+}
+
+func TestBoundingBoxContains(t *testing.T) {
+	box := BoundingBox{MinLng: -10, MinLat: -5, MaxLng: 10, MaxLat: 5}
+	assert.True(t, box.contains(0, 0))
+	assert.True(t, box.contains(5, -10))
+	assert.False(t, box.contains(6, 0))
+	assert.False(t, box.contains(0, 11))
+
+	fiji := BoundingBox{MinLng: 170, MinLat: -20, MaxLng: -170, MaxLat: -10}
+	assert.True(t, fiji.contains(-17, 178))
+	assert.True(t, fiji.contains(-17, -179))
+	assert.False(t, fiji.contains(-17, 0))
+	assert.False(t, fiji.contains(0, 178))
+}
+
+func TestHaversine(t *testing.T) {
+	assert.Equal(t, 0.0, haversine(10, 20, 10, 20))
+
+	// Paris to London is about 343.5km
+	assert.InDelta(t, 343500, haversine(48.8566, 2.3522, 51.5074, -0.1278), 1000)
+
+	// one degree of longitude on the equator, crossing the antimeridian
+	assert.InDelta(t, earthRadius*math.Pi/180, haversine(0, 179.5, 0, -179.5), 0.001)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Representations a marker listing can be answered with, picked by the format query or the Accept header
+const (
+	formatJSON    = "json"
+	formatGeoJSON = "geojson"
+)
+
+// formatMediaTypes maps every format to the media type it is sent as
+var formatMediaTypes = map[string]string{
+	formatJSON:    "application/json",
+	formatGeoJSON: "application/geo+json",
+}
+
+var errUnknownFormat = errors.New("format must be json or geojson")
+
+// listingFormat picks the representation of a marker listing.
+// The format query wins over the Accept header, and plain JSON is the default.
+func listingFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if _, ok := formatMediaTypes[format]; !ok {
+			return "", errUnknownFormat
+		}
+		return format, nil
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		for format, formatType := range formatMediaTypes {
+			if mediaType == formatType {
+				return format, nil
+			}
+		}
+	}
+	return formatJSON, nil
+}
+
+// writeMarkers answers a marker listing in the given format
+func writeMarkers(w http.ResponseWriter, format string, markers *MarkerCollection) {
+	w.Header().Add("Vary", "Accept")
+
+	switch format {
+	case formatGeoJSON:
+		writeJSONAs(w, formatMediaTypes[formatGeoJSON], http.StatusOK, newFeatureCollection(markers))
+	default:
+		writeJSON(w, http.StatusOK, markers)
+	}
+}
+
+// featureCollection is an RFC 7946 FeatureCollection of marker points
+type featureCollection struct {
+	Type     string    `json:"type"`
+	Features []feature `json:"features"`
+
+	// NextCursor is a foreign member carrying the pagination cursor of the listing
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type feature struct {
+	Type       string            `json:"type"`
+	ID         int64             `json:"id"`
+	Geometry   point             `json:"geometry"`
+	Properties featureProperties `json:"properties"`
+}
+
+// point is a GeoJSON Point, its coordinates are longitude first
+type point struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+type featureProperties struct {
+	ID         int64      `json:"id"`
+	User       string     `json:"user"`
+	Note       string     `json:"note"`
+	Visibility string     `json:"visibility"`
+	VisitedAt  *time.Time `json:"visited_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	Distance   *float64   `json:"distance,omitempty"`
+}
+
+func newFeatureCollection(markers *MarkerCollection) *featureCollection {
+	collection := &featureCollection{
+		Type:       "FeatureCollection",
+		Features:   make([]feature, len(markers.Markers)),
+		NextCursor: markers.NextCursor,
+	}
+
+	for i, m := range markers.Markers {
+		collection.Features[i] = feature{
+			Type:     "Feature",
+			ID:       m.ID,
+			Geometry: point{Type: "Point", Coordinates: [2]float64{m.Lng, m.Lat}},
+			Properties: featureProperties{
+				ID:         m.ID,
+				User:       m.User,
+				Note:       m.Note,
+				Visibility: m.Visibility,
+				VisitedAt:  m.VisitedAt,
+				CreatedAt:  m.CreatedAt,
+				UpdatedAt:  m.UpdatedAt,
+				Distance:   m.Distance,
+			},
+		}
+	}
+	return collection
+}
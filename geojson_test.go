@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryGetMarkersAsGeoJSON(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	s.store.Insert(&Marker{User: "string3", Lat: 48.85, Lng: 2.35, Note: "paris"})
+	s.store.Insert(&Marker{User: "string3", Lat: 45.76, Lng: 4.83, Note: "lyon"})
+
+	requests := []struct {
+		url    string
+		accept string
+	}{
+		{"/marker?limit=1", "application/geo+json"},
+		{"/marker?limit=1&format=geojson", ""},
+		{"/marker?limit=1&format=geojson", "application/json"},
+		{"/marker?limit=1", "text/html, application/geo+json;q=0.9"},
+	}
+
+	for _, tt := range requests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		req.Header.Set("Authorization", stubAuthHeader)
+		req.Header.Set("Accept", tt.accept)
+		res := httptest.NewRecorder()
+		s.router.ServeHTTP(res, req)
+
+		assert.Equal(t, http.StatusOK, res.Code, tt.url)
+		assert.Equal(t, "application/geo+json", res.Header().Get("Content-Type"), tt.url)
+		assert.Equal(t, `{"type":"FeatureCollection","features":[{"type":"Feature","id":1,"geometry":{"type":"Point","coordinates":[2.35,48.85]},"properties":{"id":1,"user":"string3","note":"paris","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}}],"next_cursor":"eyJpZCI6MX0"}`, res.Body.String(), tt.url)
+	}
+}
+
+func TestMemoryGetNearMarkersAsGeoJSON(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	s.store.Insert(&Marker{User: "string3", Lat: 0, Lng: 0, Note: "origin"})
+
+	req, _ := http.NewRequest("GET", "/marker/near?lat=0&lng=0&limit=5&format=geojson", nil)
+	req.Header.Set("Authorization", stubAuthHeader)
+	res := httptest.NewRecorder()
+	s.router.ServeHTTP(res, req)
+
+	assert.Equal(t, `{"type":"FeatureCollection","features":[{"type":"Feature","id":1,"geometry":{"type":"Point","coordinates":[0,0]},"properties":{"id":1,"user":"string3","note":"origin","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z","distance":0}}]}`, res.Body.String())
+
+	req, _ = http.NewRequest("GET", "/marker?format=shapefile", nil)
+	req.Header.Set("Authorization", stubAuthHeader)
+	res = httptest.NewRecorder()
+	s.router.ServeHTTP(res, req)
+
+	assertProblem(t, res, problemInvalidQuery)
+}
+
+func TestEmptyFeatureCollection(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	req, _ := http.NewRequest("GET", "/marker", nil)
+	req.Header.Set("Authorization", stubAuthHeader)
+	req.Header.Set("Accept", "application/geo+json")
+	res := httptest.NewRecorder()
+	s.router.ServeHTTP(res, req)
+
+	assert.Equal(t, `{"type":"FeatureCollection","features":[]}`, res.Body.String())
+	assert.Equal(t, "Accept", res.Header().Get("Vary"))
+}
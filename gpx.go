@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// gpxNamespace is the namespace of GPX 1.1 documents, older 1.0 files are read as well
+const gpxNamespace = "http://www.topografix.com/GPX/1/1"
+
+// defaultTrackSpacing is the distance in meters kept between imported track points when spacing is not given
+const defaultTrackSpacing = 100
+
+// gpxDocument is the subset of a GPX file the service reads and writes
+type gpxDocument struct {
+	XMLName   xml.Name   `xml:"gpx"`
+	Namespace string     `xml:"xmlns,attr,omitempty"`
+	Version   string     `xml:"version,attr"`
+	Creator   string     `xml:"creator,attr"`
+	Metadata  *gpxMeta   `xml:"metadata,omitempty"`
+	Waypoints []gpxPoint `xml:"wpt"`
+	Tracks    []gpxTrack `xml:"trk"`
+}
+
+type gpxMeta struct {
+	Name string `xml:"name,omitempty"`
+}
+
+type gpxPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Name string  `xml:"name,omitempty"`
+	Desc string  `xml:"desc,omitempty"`
+}
+
+type gpxTrack struct {
+	Segments []gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+// gpxImport tells which parts of a GPX file become markers
+type gpxImport struct {
+	// Tracks also imports track points, keeping one every Spacing meters
+	Tracks  bool
+	Spacing float64
+}
+
+func getGPXImport(values url.Values) (*gpxImport, error) {
+	options := gpxImport{Spacing: defaultTrackSpacing}
+	var err error
+
+	if tracks := values.Get("tracks"); tracks != "" {
+		if options.Tracks, err = strconv.ParseBool(tracks); err != nil {
+			return nil, errors.New("tracks must be true or false")
+		}
+	}
+
+	if spacing := values.Get("spacing"); spacing != "" {
+		if options.Spacing, err = strconv.ParseFloat(spacing, 64); err != nil || !(options.Spacing > 0) {
+			return nil, errors.New("spacing must be a positive number of meters")
+		}
+	}
+
+	return &options, nil
+}
+
+// readGPX turns the waypoints of a GPX file, and its thinned track points when asked, into markers of user
+func readGPX(body io.Reader, user string, options gpxImport) ([]Marker, error) {
+	var document gpxDocument
+	if err := xml.NewDecoder(body).Decode(&document); err != nil {
+		return nil, err
+	}
+
+	var markers []Marker
+	for _, wpt := range document.Waypoints {
+		markers = append(markers, Marker{User: user, Lat: wpt.Lat, Lng: wpt.Lon, Note: gpxNote(wpt)})
+	}
+
+	if !options.Tracks {
+		return markers, nil
+	}
+
+	for _, track := range document.Tracks {
+		for _, segment := range track.Segments {
+			var last *gpxPoint
+			for i := range segment.Points {
+				trkpt := &segment.Points[i]
+				if last != nil && haversine(last.Lat, last.Lon, trkpt.Lat, trkpt.Lon) < options.Spacing {
+					continue
+				}
+				markers = append(markers, Marker{User: user, Lat: trkpt.Lat, Lng: trkpt.Lon, Note: gpxNote(*trkpt)})
+				last = trkpt
+			}
+		}
+	}
+	return markers, nil
+}
+
+// gpxNote joins the name and description of a point.
+// A description starting with the name, as written by writeGPX, is already the whole note.
+func gpxNote(p gpxPoint) string {
+	name, desc := strings.TrimSpace(p.Name), strings.TrimSpace(p.Desc)
+	if desc == "" {
+		return name
+	}
+	if name == "" || noteTitle(desc) == name {
+		return desc
+	}
+	return name + "\n" + desc
+}
+
+// writeGPX streams markers as GPX 1.1 waypoints, named by the first line of their note and described by the whole note
+func writeGPX(w io.Writer, source *exportSource) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+
+	root := xml.StartElement{Name: xml.Name{Local: "gpx"}, Attr: []xml.Attr{
+		{Name: xml.Name{Local: "xmlns"}, Value: gpxNamespace},
+		{Name: xml.Name{Local: "version"}, Value: "1.1"},
+		{Name: xml.Name{Local: "creator"}, Value: "trip-pin-points-markers"},
+	}}
+	if err := encoder.EncodeToken(root); err != nil {
+		return err
+	}
+	if err := encoder.EncodeElement(gpxMeta{Name: source.Name}, xml.StartElement{Name: xml.Name{Local: "metadata"}}); err != nil {
+		return err
+	}
+
+	err := source.each(func(m *Marker) error {
+		wpt := gpxPoint{Lat: m.Lat, Lon: m.Lng, Name: noteTitle(m.Note)}
+		if m.Note != wpt.Name {
+			wpt.Desc = m.Note
+		}
+		return encoder.EncodeElement(wpt, xml.StartElement{Name: xml.Name{Local: "wpt"}})
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := encoder.EncodeToken(root.End()); err != nil {
+		return err
+	}
+	return encoder.Flush()
+}
+
+// noteTitle is the first line of a note, used where formats want a short name
+func noteTitle(note string) string {
+	if i := strings.IndexByte(note, '\n'); i >= 0 {
+		return note[:i]
+	}
+	return note
+}
+
+func (s *server) handleImportGPX() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		options, err := getGPXImport(r.URL.Query())
+		if err != nil {
+			s.writeProblem(w, r, problemInvalidQuery, err.Error(), err)
+			return
+		}
+
+		markers, err := readGPX(http.MaxBytesReader(w, r.Body, maxImportSize), userZid, *options)
+		if err != nil {
+			s.writeProblem(w, r, problemInvalidBody, "Body must be a valid GPX document", err)
+			return
+		}
+
+		imported, err := s.insertImported(markers)
+		if err != nil {
+			s.writeImportError(w, r, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, imported)
+	}
+}
+
+func (s *server) handleExportGPX() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		tripID, err := getExportTrip(r.URL.Query())
+		if err != nil {
+			s.writeProblem(w, r, problemInvalidQuery, err.Error(), err)
+			return
+		}
+
+		source, err := s.openExport(userZid, tripID)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		writeAttachment(w, "application/gpx+xml", "markers.gpx")
+		if err = writeGPX(w, source); err != nil {
+			s.logger.Info("Could not write GPX export", zap.Error(err))
+		}
+	}
+}
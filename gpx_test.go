@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const gpxSample = `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="eTrex 32x" xmlns="http://www.topografix.com/GPX/1/1">
+  <wpt lat="46.5580" lon="7.8350"><name>Trailhead</name><desc>Parking by the station</desc></wpt>
+  <wpt lat="46.5600" lon="7.8400"><name>Lake</name></wpt>
+  <trk>
+    <trkseg>
+      <trkpt lat="46.5580" lon="7.8350"></trkpt>
+      <trkpt lat="46.5581" lon="7.8351"></trkpt>
+      <trkpt lat="46.5700" lon="7.8350"></trkpt>
+    </trkseg>
+  </trk>
+</gpx>`
+
+func TestMemoryImportGPX(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	res := serveAs(s, "POST", "/import/gpx", gpxSample)
+	assert.Equal(t, http.StatusCreated, res.Code)
+	assert.Equal(t, `{"markers":[{"id":1,"user":"string3","lat":46.558,"lng":7.835,"note":"Trailhead\nParking by the station","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"},{"id":2,"user":"string3","lat":46.56,"lng":7.84,"note":"Lake","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}]}`, res.Body.String())
+
+	res = serveAs(s, "POST", "/import/gpx?tracks=true&spacing=500", gpxSample)
+	assert.Equal(t, http.StatusCreated, res.Code)
+
+	markers, _ := s.store.List("string3", MarkerFilter{})
+	assert.Len(t, markers.Markers, 6)
+	assert.Equal(t, 46.57, markers.Markers[5].Lat)
+}
+
+func TestMemoryImportInvalidGPX(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	res := serveAs(s, "POST", "/import/gpx", `<gpx><wpt lat="91" lon="7"/><wpt lat="1" lon="-200"/></gpx>`)
+	assertProblem(t, res, problemValidation, fieldError{"markers[0].lat", "must be between -90 and 90"}, fieldError{"markers[1].lng", "must be between -180 and 180"})
+
+	res = serveAs(s, "POST", "/import/gpx", `{"lat":1,"lng":2}`)
+	assertProblem(t, res, problemInvalidBody)
+
+	res = serveAs(s, "POST", "/import/gpx?spacing=-1&tracks=true", gpxSample)
+	assertProblem(t, res, problemInvalidQuery)
+
+	markers, _ := s.store.List("string3", MarkerFilter{})
+	assert.Empty(t, markers.Markers)
+}
+
+func TestImportGPXRollsBackOnFailure(t *testing.T) {
+	s, mock := getMockServer()
+	defer s.finalize()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO markers").
+		WithArgs("string3", 46.558, 7.835, "Trailhead\nParking by the station", nil, nil, "members").
+		WillReturnRows(insertedRow(1))
+	mock.ExpectQuery("INSERT INTO markers").
+		WithArgs("string3", 46.56, 7.84, "Lake", nil, nil, "members").
+		WillReturnError(errors.New("test error"))
+	mock.ExpectRollback()
+
+	res := serveAs(s, "POST", "/import/gpx", gpxSample)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assertProblem(t, res, problemStorage)
+}
+
+func TestMemoryExportGPX(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	s.store.Insert(&Marker{User: "string3", Lat: 46.558, Lng: 7.835, Note: "Trailhead\nParking by the station"})
+	s.store.Insert(&Marker{User: "string3", Lat: 46.56, Lng: 7.84, Note: "Lake"})
+	s.store.Insert(&Marker{User: "someone-else", Lat: 1, Lng: 1, Note: "not mine"})
+	s.trips.InsertTrip(&Trip{User: "string3", Name: "Lakes"})
+	s.trips.SetTripMarkers("string3", 1, "string3", []int64{2})
+
+	res := serveAs(s, "GET", "/export/gpx", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "application/gpx+xml", res.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="markers.gpx"`, res.Header().Get("Content-Disposition"))
+	assert.Equal(t, `<?xml version="1.0" encoding="UTF-8"?>
+<gpx xmlns="http://www.topografix.com/GPX/1/1" version="1.1" creator="trip-pin-points-markers">
+  <metadata>
+    <name>Markers of string3</name>
+  </metadata>
+  <wpt lat="46.558" lon="7.835">
+    <name>Trailhead</name>
+    <desc>Trailhead&#xA;Parking by the station</desc>
+  </wpt>
+  <wpt lat="46.56" lon="7.84">
+    <name>Lake</name>
+  </wpt>
+</gpx>`, res.Body.String())
+
+	roundTrip, err := readGPX(res.Body, "string3", gpxImport{})
+	assert.NoError(t, err)
+	assert.Equal(t, []Marker{
+		{User: "string3", Lat: 46.558, Lng: 7.835, Note: "Trailhead\nParking by the station"},
+		{User: "string3", Lat: 46.56, Lng: 7.84, Note: "Lake"},
+	}, roundTrip)
+
+	res = serveAs(s, "GET", "/export/gpx?trip=1", "")
+	assert.Contains(t, res.Body.String(), "<name>Lakes</name>")
+	assert.NotContains(t, res.Body.String(), "Trailhead")
+
+	res = serveAs(s, "GET", "/export/gpx?trip=2", "")
+	assertProblem(t, res, problemNotFound)
+}
@@ -5,12 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
-	"regexp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
-	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
-	"go.uber.org/zap"
 )
 
 func (s *server) handleHealthcheck() http.HandlerFunc {
@@ -22,9 +24,9 @@ func (s *server) handleHealthcheck() http.HandlerFunc {
 
 func (s *server) handlePingDB() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := s.db.Ping()
+		err := s.store.Ping()
 		if err != nil {
-			w.WriteHeader(http.StatusServiceUnavailable)
+			s.writeProblem(w, r, problemUnavailable, "Could not reach the marker storage", err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -32,140 +34,815 @@ func (s *server) handlePingDB() http.HandlerFunc {
 	}
 }
 
-func getUserZID(s *server, w http.ResponseWriter, r *http.Request) string {
-	w.Header().Set("Content-Type", "application/json")
+func (s *server) handleGetAllMarkers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-	regex := regexp.MustCompile("^Bearer (.*)")
-	rawHeader := r.Header.Get("Authorization")
-	matches := regex.FindStringSubmatch(rawHeader)
-	if len(matches) <= 1 {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, `{"message":"Could not find Authorization header"}`)
-		return ""
-	}
-	bearerToken := matches[1]
+		userZid := principalFrom(r.Context()).ZID
+
+		filter, err := getMarkerFilter(r.URL.Query())
+		if err != nil {
+			s.writeProblem(w, r, problemInvalidQuery, err.Error(), err)
+			return
+		}
+
+		format, err := listingFormat(r)
+		if err != nil {
+			s.writeProblem(w, r, problemInvalidQuery, err.Error(), err)
+			return
+		}
 
-	token, err := jwt.Parse(bearerToken, func(*jwt.Token) (interface{}, error) {
-		return s.authKey, nil
-	})
+		markers, err := s.store.List(userZid, *filter)
 
-	if err != nil || !token.Valid {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, `{"message":"Invalid Token"}`)
-		return ""
-	}
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find markers")
+			return
+		}
 
-	claims := token.Claims.(jwt.MapClaims)
-	return fmt.Sprintf("%v", claims["zid"])
+		writeMarkers(w, format, markers)
+	}
 }
 
-func (s *server) handleGetAllMarkers() http.HandlerFunc {
+func (s *server) handleGetNearMarkers() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		userZid := getUserZID(s, w, r)
-		if userZid == "" {
+		userZid := principalFrom(r.Context()).ZID
+
+		query, err := getNearQuery(r.URL.Query())
+		if err != nil {
+			s.writeProblem(w, r, problemInvalidQuery, err.Error(), err)
+			return
+		}
+
+		format, err := listingFormat(r)
+		if err != nil {
+			s.writeProblem(w, r, problemInvalidQuery, err.Error(), err)
 			return
 		}
 
-		markers, err := getMarkerCollection(userZid, s.db)
+		markers, err := s.store.Near(userZid, *query)
 
 		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			s.logger.Info("Could not find markers", zap.Error(err))
-			fmt.Fprint(w, `{"message":"Could not find markers"}`)
+			s.writeStoreError(w, r, err, "Could not find markers")
 			return
 		}
 
-		response, _ := json.Marshal(markers)
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, string(response))
+		writeMarkers(w, format, markers)
 	}
 }
 
 func (s *server) handleGetSingleMarker() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		userZid := getUserZID(s, w, r)
-		if userZid == "" {
+		userZid := principalFrom(r.Context()).ZID
+
+		lat, lng, err := getCoordinates(mux.Vars(r))
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find marker", err)
 			return
 		}
 
-		params := mux.Vars(r)
-		markers, err := getMarker(userZid, params["lat"], params["lng"], s.db)
+		markers, err := s.store.GetAt(userZid, lat, lng)
 
 		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			s.logger.Info("Could not find markers", zap.Error(err))
-			fmt.Fprint(w, `{"message":"Could not find marker"}`)
+			s.writeStoreError(w, r, err, "Could not find marker")
 			return
 		}
 
-		response, _ := json.Marshal(markers)
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, string(response))
+		writeJSON(w, http.StatusOK, markers)
 	}
 }
 
 func (s *server) handleInsertMarker() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		userZid := getUserZID(s, w, r)
-		if userZid == "" {
+		userZid := principalFrom(r.Context()).ZID
+
+		marker, err := getNewMarker(r.Body, userZid)
+		if err != nil {
+			s.writeBodyError(w, r, err)
+			return
+		}
+
+		if err = s.store.Insert(marker); err != nil {
+			s.writeStoreError(w, r, err, "")
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, marker)
+	}
+}
+
+func (s *server) handleDeleteMarker() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		lat, lng, err := getCoordinates(mux.Vars(r))
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find marker", err)
+			return
+		}
+
+		if err := s.store.DeleteAt(userZid, lat, lng); err != nil {
+			s.writeStoreError(w, r, err, "Could not find marker")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *server) handleGetMarkerByID() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		id, err := getMarkerID(mux.Vars(r))
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find marker", err)
+			return
+		}
+
+		marker, err := s.store.Get(userZid, id)
+
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find marker")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, marker)
+	}
+}
+
+func (s *server) handleUpdateMarker() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		id, err := getMarkerID(mux.Vars(r))
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find marker", err)
 			return
 		}
 
 		marker, err := getNewMarker(r.Body, userZid)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			s.logger.Info("Could not parse given body", zap.Error(err))
-			fmt.Fprint(w, `{"message":"Could not parse given body"}`)
+			s.writeBodyError(w, r, err)
 			return
 		}
+		marker.ID = id
 
-		if err = marker.save(s.db); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			s.logger.Error("Could not insert in database", zap.Error(err))
-			fmt.Fprint(w, `{"message":"Could not insert in database"}`)
+		if err = s.store.Update(marker); err != nil {
+			s.writeStoreError(w, r, err, "Could not find marker")
 			return
 		}
 
-		response, _ := json.Marshal(marker)
-		w.WriteHeader(http.StatusCreated)
-		fmt.Fprint(w, string(response))
+		writeJSON(w, http.StatusOK, marker)
 	}
 }
 
-func (s *server) handleDeleteMarker() http.HandlerFunc {
+func (s *server) handlePatchMarker() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		userZid := getUserZID(s, w, r)
-		if userZid == "" {
+		userZid := principalFrom(r.Context()).ZID
+
+		id, err := getMarkerID(mux.Vars(r))
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find marker", err)
 			return
 		}
 
-		params := mux.Vars(r)
+		marker, err := s.store.Get(userZid, id)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find marker")
+			return
+		}
+
+		mergePatch := strings.HasPrefix(r.Header.Get("Content-Type"), "application/merge-patch+json")
+		if err = applyMarkerPatch(marker, r.Body, mergePatch); err != nil {
+			s.writeBodyError(w, r, err)
+			return
+		}
+
+		if err = s.store.Update(marker); err != nil {
+			s.writeStoreError(w, r, err, "Could not find marker")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, marker)
+	}
+}
+
+func (s *server) handleDeleteMarkerByID() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		id, err := getMarkerID(mux.Vars(r))
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find marker", err)
+			return
+		}
 
-		if err := deleteMarker(userZid, params["lat"], params["lng"], s.db); err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			s.logger.Error("Could not insert in database", zap.Error(err))
-			fmt.Fprint(w, `{"message":"Could not delete marker"}`)
+		if err := s.store.Delete(userZid, id); err != nil {
+			s.writeStoreError(w, r, err, "Could not find marker")
+			return
 		}
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
-func getNewMarker(body io.ReadCloser, user string) (*Marker, error) {
+func (s *server) handleGetAllTrips() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-	var marker Marker
+		userZid := principalFrom(r.Context()).ZID
 
-	decoder := json.NewDecoder(body)
-	err := decoder.Decode(&marker)
+		trips, err := s.trips.ListTrips(userZid)
+
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trips")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, trips)
+	}
+}
+
+func (s *server) handleInsertTrip() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		trip, err := getNewTrip(r.Body, userZid)
+		if err != nil {
+			s.writeBodyError(w, r, err)
+			return
+		}
+
+		if err = s.checkCover(trip); err != nil {
+			s.writeTripError(w, r, err)
+			return
+		}
+
+		if err = s.trips.InsertTrip(trip); err != nil {
+			s.writeStoreError(w, r, err, "")
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, trip)
+	}
+}
+
+func (s *server) handleGetTrip() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		id, err := getTripID(mux.Vars(r))
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find trip", err)
+			return
+		}
+
+		access, err := s.tripAccess(userZid, id, roleViewer)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		trip, err := s.tripWithMarkers(access.Creator, id, userZid)
+
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, trip)
+	}
+}
+
+func (s *server) handleUpdateTrip() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		id, err := getTripID(mux.Vars(r))
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find trip", err)
+			return
+		}
+
+		access, err := s.tripAccess(userZid, id, roleOwner)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
 
-	if err != nil || marker.Lat == 0 || marker.Lng == 0 {
-		return nil, errors.New("Invalid marker format")
+		trip, err := getNewTrip(r.Body, access.Creator)
+		if err != nil {
+			s.writeBodyError(w, r, err)
+			return
+		}
+		trip.ID = id
+
+		if err = s.checkCover(trip); err != nil {
+			s.writeTripError(w, r, err)
+			return
+		}
+
+		if err = s.trips.UpdateTrip(trip); err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, trip)
+	}
+}
+
+func (s *server) handleDeleteTrip() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		id, err := getTripID(mux.Vars(r))
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find trip", err)
+			return
+		}
+
+		access, err := s.tripAccess(userZid, id, roleOwner)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		if err := s.trips.DeleteTrip(access.Creator, id); err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleSetTripMarkers replaces the markers of a trip the caller can see with the ordered marker_ids of the body
+func (s *server) handleSetTripMarkers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		id, err := getTripID(mux.Vars(r))
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find trip", err)
+			return
+		}
+
+		access, err := s.tripAccess(userZid, id, roleEditor)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		markerIDs, err := getTripMarkerIDs(r.Body)
+		if err != nil {
+			s.writeBodyError(w, r, err)
+			return
+		}
+
+		if err = s.trips.SetTripMarkers(access.Creator, id, userZid, markerIDs); err != nil {
+			s.writeTripError(w, r, err)
+			return
+		}
+
+		trip, err := s.tripWithMarkers(access.Creator, id, userZid)
+
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, trip)
+	}
+}
+
+// handlePatchTripMarker lets the editors of a trip change any of its markers, whoever they belong to,
+// only the owner of a marker can change its visibility
+func (s *server) handlePatchTripMarker() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		params := mux.Vars(r)
+		id, err := getTripID(params)
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find trip", err)
+			return
+		}
+
+		markerID, err := strconv.ParseInt(params["marker_id"], 10, 64)
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find marker in this trip", err)
+			return
+		}
+
+		access, err := s.tripAccess(userZid, id, roleEditor)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		markers, err := s.trips.TripMarkers(access.Creator, id)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+		markers = visibleMarkers(markers, userZid)
+
+		var marker *Marker
+		for i := range markers {
+			if markers[i].ID == markerID {
+				marker = &markers[i]
+				break
+			}
+		}
+		if marker == nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find marker in this trip", errMarkerNotFound)
+			return
+		}
+
+		visibility := marker.Visibility
+		mergePatch := strings.HasPrefix(r.Header.Get("Content-Type"), "application/merge-patch+json")
+		if err = applyMarkerPatch(marker, r.Body, mergePatch); err != nil {
+			s.writeBodyError(w, r, err)
+			return
+		}
+		if marker.User != userZid && marker.Visibility != visibility {
+			errs := &validationError{}
+			errs.add("visibility", "can only be changed by the owner of the marker")
+			s.writeBodyError(w, r, errs)
+			return
+		}
+
+		marker.ChangedBy = userZid
+		if err = s.store.Update(marker); err != nil {
+			s.writeStoreError(w, r, err, "Could not find marker in this trip")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, marker)
+	}
+}
+
+// tripAccess makes sure user holds at least role on a trip.
+// Users taking no part in the trip are told it does not exist.
+func (s *server) tripAccess(user string, id int64, role string) (*TripAccess, error) {
+	access, err := s.trips.TripAccess(user, id)
+	if err != nil {
+		return nil, err
+	}
+	if !access.allows(role) {
+		return nil, errTripRole
+	}
+	return access, nil
+}
+
+// tripWithMarkers reads a trip created by user along with the markers viewer can see in it
+func (s *server) tripWithMarkers(user string, id int64, viewer string) (*TripWithMarkers, error) {
+	trip, err := s.trips.GetTrip(user, id)
+	if err != nil {
+		return nil, err
+	}
+
+	markers, err := s.trips.TripMarkers(user, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TripWithMarkers{Trip: *trip, Markers: visibleMarkers(markers, viewer)}, nil
+}
+
+// visibleMarkers leaves out the private markers of trip members other than viewer
+func visibleMarkers(markers []Marker, viewer string) []Marker {
+	visible := markers[:0]
+	for _, m := range markers {
+		if m.User == viewer || m.Visibility != visibilityPrivate {
+			visible = append(visible, m)
+		}
+	}
+	return visible
+}
+
+// checkCover makes sure the cover of trip is a marker of the same user
+func (s *server) checkCover(trip *Trip) error {
+	if trip.CoverMarkerID == nil {
+		return nil
+	}
+
+	_, err := s.store.Get(trip.User, *trip.CoverMarkerID)
+	if err == errMarkerNotFound {
+		errs := &validationError{}
+		errs.add("cover_marker_id", "must be one of your markers")
+		return errs
+	}
+	return err
+}
+
+// writeTripError answers a failed trip change, where a missing marker is a mistake of the body
+func (s *server) writeTripError(w http.ResponseWriter, r *http.Request, err error) {
+	if _, ok := err.(*validationError); ok {
+		s.writeBodyError(w, r, err)
+		return
+	}
+
+	if err == errMarkerNotFound {
+		errs := &validationError{}
+		errs.add("marker_ids", "must only contain your markers")
+		s.writeBodyError(w, r, errs)
+		return
+	}
+	s.writeStoreError(w, r, err, "Could not find trip")
+}
+
+// writeJSON answers with v encoded as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	writeJSONAs(w, "application/json", status, v)
+}
+
+// writeJSONAs answers with v encoded as JSON under a more specific media type
+func writeJSONAs(w http.ResponseWriter, contentType string, status int, v interface{}) {
+	response, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	fmt.Fprint(w, string(response))
+}
+
+func getMarkerID(params map[string]string) (int64, error) {
+	return strconv.ParseInt(params["id"], 10, 64)
+}
+
+func getTripID(params map[string]string) (int64, error) {
+	return strconv.ParseInt(params["id"], 10, 64)
+}
+
+func getCoordinates(params map[string]string) (float64, float64, error) {
+
+	lat, err := strconv.ParseFloat(params["lat"], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	lng, err := strconv.ParseFloat(params["lng"], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return lat, lng, nil
+}
+
+// maxPageSize is the largest limit accepted when paginating markers
+const maxPageSize = 1000
+
+func getMarkerFilter(values url.Values) (*MarkerFilter, error) {
+	var filter MarkerFilter
+	var err error
+
+	if bbox := values.Get("bbox"); bbox != "" {
+		if filter.Box, err = parseBoundingBox(bbox); err != nil {
+			return nil, err
+		}
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 1 || filter.Limit > maxPageSize {
+			return nil, fmt.Errorf("limit must be an integer between 1 and %d", maxPageSize)
+		}
+	}
+
+	moments := []struct {
+		name  string
+		bound **time.Time
+	}{
+		{"visited_after", &filter.VisitedAfter},
+		{"visited_before", &filter.VisitedBefore},
+		{"as_of", &filter.AsOf},
+	}
+	for _, moment := range moments {
+		if raw := values.Get(moment.name); raw != "" {
+			if *moment.bound, err = parseTimeQuery(raw); err != nil {
+				return nil, fmt.Errorf("%s must be a RFC 3339 time or a YYYY-MM-DD date", moment.name)
+			}
+		}
+	}
+
+	if sort := values.Get("sort"); sort != "" {
+		if filter.Sort, err = parseMarkerSort(sort); err != nil {
+			return nil, err
+		}
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		if filter.After, err = decodeCursor(cursor); err != nil {
+			return nil, err
+		}
+		if filter.After.Sort != filter.Sort.String() {
+			return nil, errors.New("cursor was given for another sort")
+		}
+	}
+
+	return &filter, nil
+}
+
+// parseTimeQuery reads a RFC 3339 time, or a date which stands for its midnight UTC
+func parseTimeQuery(raw string) (*time.Time, error) {
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		if t, err = time.Parse(dateLayout, raw); err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+func getNearQuery(values url.Values) (*NearQuery, error) {
+	var query NearQuery
+	var err error
+
+	if query.Lat, err = strconv.ParseFloat(values.Get("lat"), 64); err != nil || query.Lat < -90 || query.Lat > 90 {
+		return nil, errors.New("lat must be a number between -90 and 90")
+	}
+
+	if query.Lng, err = strconv.ParseFloat(values.Get("lng"), 64); err != nil || query.Lng < -180 || query.Lng > 180 {
+		return nil, errors.New("lng must be a number between -180 and 180")
+	}
+
+	if radius := values.Get("radius"); radius != "" {
+		if query.Radius, err = strconv.ParseFloat(radius, 64); err != nil || !(query.Radius > 0) || math.IsInf(query.Radius, 0) {
+			return nil, errors.New("radius must be a positive number of meters")
+		}
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 1 {
+			return nil, errors.New("limit must be a positive integer")
+		}
+	}
+
+	if query.Radius == 0 && query.Limit == 0 {
+		return nil, errors.New("radius or limit must be given")
+	}
+
+	return &query, nil
+}
+
+// markerFields are the fields a client can set on a marker, in the order they are validated
+var markerFields = []string{"lat", "lng", "note", "visited_at", "visibility"}
+
+func getNewMarker(body io.Reader, user string) (*Marker, error) {
+
+	fields, err := decodeObject(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var marker Marker
+	errs := &validationError{}
+
+	for _, field := range markerFields {
+		value, ok := fields[field]
+		if !ok || isJSONNull(value) {
+			if field == "lat" || field == "lng" {
+				errs.add(field, "is required")
+			}
+			continue
+		}
+		setMarkerField(&marker, field, value, errs)
+	}
+
+	if err = errs.orNil(); err != nil {
+		return nil, err
 	}
 
 	marker.User = user
 
 	return &marker, nil
 }
+
+// applyMarkerPatch changes marker with the fields present in body, leaving the other ones untouched.
+// When mergePatch is set the body follows RFC 7386, where a null value removes the field.
+func applyMarkerPatch(marker *Marker, body io.Reader, mergePatch bool) error {
+
+	fields, err := decodeObject(body)
+	if err != nil {
+		return err
+	}
+
+	patched := *marker
+	errs := &validationError{}
+
+	for _, field := range markerFields {
+		value, ok := fields[field]
+		if !ok || (isJSONNull(value) && !mergePatch) {
+			continue
+		}
+
+		if isJSONNull(value) {
+			switch field {
+			case "note":
+				patched.Note = ""
+			case "visited_at":
+				patched.VisitedAt = nil
+			default:
+				errs.add(field, "can not be removed")
+			}
+			continue
+		}
+		setMarkerField(&patched, field, value, errs)
+	}
+
+	if err = errs.orNil(); err != nil {
+		return err
+	}
+
+	*marker = patched
+	return nil
+}
+
+// decodeObject reads a JSON object keeping its fields raw, so missing fields can be told apart from zero values
+func decodeObject(body io.Reader) (map[string]json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+
+	decoder := json.NewDecoder(body)
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return nil, errors.New("Body must be a JSON object")
+	}
+	return fields, nil
+}
+
+// tripFields are the fields a client can set on a trip, in the order they are validated
+var tripFields = []string{"name", "description", "start_date", "end_date", "cover_marker_id", "visibility"}
+
+func getNewTrip(body io.Reader, user string) (*Trip, error) {
+
+	fields, err := decodeObject(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var trip Trip
+	errs := &validationError{}
+
+	for _, field := range tripFields {
+		value, ok := fields[field]
+		if !ok {
+			if field == "name" {
+				errs.add(field, "is required")
+			}
+			continue
+		}
+		setTripField(&trip, field, value, errs)
+	}
+	validateTripDates(&trip, errs)
+
+	if err = errs.orNil(); err != nil {
+		return nil, err
+	}
+
+	trip.User = user
+
+	return &trip, nil
+}
+
+// getTripMarkerIDs reads the ordered marker ids of a trip, each marker can only be listed once
+func getTripMarkerIDs(body io.Reader) ([]int64, error) {
+
+	fields, err := decodeObject(body)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := &validationError{}
+
+	value, ok := fields["marker_ids"]
+	if !ok {
+		errs.add("marker_ids", "is required")
+		return nil, errs
+	}
+
+	var markerIDs []int64
+	if err = json.Unmarshal(value, &markerIDs); err != nil || markerIDs == nil {
+		errs.add("marker_ids", "must be a list of marker ids")
+		return nil, errs
+	}
+
+	seen := map[int64]bool{}
+	for _, id := range markerIDs {
+		if seen[id] {
+			errs.add("marker_ids", fmt.Sprintf("lists marker %d more than once", id))
+			return nil, errs
+		}
+		seen[id] = true
+	}
+
+	return markerIDs, nil
+}
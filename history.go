@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+func (s *server) handleGetMarkerHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		id, err := getMarkerID(mux.Vars(r))
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find marker", err)
+			return
+		}
+
+		history, err := s.store.History(userZid, id)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find marker")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, history)
+	}
+}
+
+// handleRevertMarker puts a marker back in the state of one of its revisions, which is recorded as a new revision.
+// Trashed markers have to be restored first.
+func (s *server) handleRevertMarker() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		id, err := getMarkerID(mux.Vars(r))
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find marker", err)
+			return
+		}
+
+		number, err := getRevisionNumber(r.Body)
+		if err != nil {
+			s.writeBodyError(w, r, err)
+			return
+		}
+
+		history, err := s.store.History(userZid, id)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find marker")
+			return
+		}
+
+		revision := history.find(number)
+		if revision == nil {
+			errs := &validationError{}
+			errs.add("revision", "is not a revision of this marker")
+			s.writeBodyError(w, r, errs)
+			return
+		}
+
+		marker, err := s.store.Get(userZid, id)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find marker")
+			return
+		}
+
+		marker.Lat, marker.Lng, marker.Note, marker.VisitedAt = revision.Lat, revision.Lng, revision.Note, revision.VisitedAt
+
+		if err = s.store.Update(marker); err != nil {
+			s.writeStoreError(w, r, err, "Could not find marker")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, marker)
+	}
+}
+
+// getRevisionNumber reads the revision a marker is reverted to
+func getRevisionNumber(body io.Reader) (int64, error) {
+
+	fields, err := decodeObject(body)
+	if err != nil {
+		return 0, err
+	}
+
+	errs := &validationError{}
+
+	value, ok := fields["revision"]
+	if !ok || isJSONNull(value) {
+		errs.add("revision", "is required")
+		return 0, errs
+	}
+
+	var number int64
+	if err = json.Unmarshal(value, &number); err != nil || number < 1 {
+		errs.add("revision", "must be a positive integer")
+		return 0, errs
+	}
+
+	return number, nil
+}
+
+func (h *MarkerHistory) find(number int64) *MarkerRevision {
+	for i := range h.Revisions {
+		if h.Revisions[i].Revision == number {
+			return &h.Revisions[i]
+		}
+	}
+	return nil
+}
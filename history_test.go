@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryMarkerHistory(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	store := s.store.(*memoryStore)
+	clockAt := func(minutes int) {
+		store.now = func() time.Time { return stubMarkerTime.Add(time.Duration(minutes) * time.Minute) }
+	}
+
+	serveAs(s, "PUT", "/marker", `{"lat":48.85,"lng":2.35,"note":"cafe on the corner"}`)
+	clockAt(10)
+	serveAs(s, "PUT", "/marker/1", `{"lat":48.85,"lng":2.35,"note":"cafe"}`)
+	serveAs(s, "PUT", "/marker/1", `{"lat":48.85,"lng":2.35,"note":"cafe"}`)
+	clockAt(20)
+	serveAs(s, "DELETE", "/marker/1", "")
+	clockAt(30)
+	serveAs(s, "POST", "/trash/1/restore", "")
+
+	res := serveAs(s, "GET", "/marker/1/history", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"marker_id":1,"revisions":[`+
+		`{"revision":1,"action":"created","lat":48.85,"lng":2.35,"note":"cafe on the corner","changed_by":"string3","changed_at":"2019-03-10T20:33:20Z"},`+
+		`{"revision":2,"action":"updated","lat":48.85,"lng":2.35,"note":"cafe","changed_by":"string3","changed_at":"2019-03-10T20:43:20Z"},`+
+		`{"revision":3,"action":"deleted","lat":48.85,"lng":2.35,"note":"cafe","changed_by":"string3","changed_at":"2019-03-10T20:53:20Z"},`+
+		`{"revision":4,"action":"restored","lat":48.85,"lng":2.35,"note":"cafe","changed_by":"string3","changed_at":"2019-03-10T21:03:20Z"}]}`,
+		res.Body.String())
+
+	asOf := map[string]string{
+		"2019-03-10T20:00:00Z": `{"markers":null}`,
+		"2019-03-10T20:40:00Z": `{"markers":[{"id":1,"user":"string3","lat":48.85,"lng":2.35,"note":"cafe on the corner","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}]}`,
+		"2019-03-10T20:50:00Z": `{"markers":[{"id":1,"user":"string3","lat":48.85,"lng":2.35,"note":"cafe","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:43:20Z"}]}`,
+		"2019-03-10T21:00:00Z": `{"markers":null}`,
+	}
+	for moment, expected := range asOf {
+		res = serveAs(s, "GET", "/marker?as_of="+moment, "")
+		assert.Equal(t, http.StatusOK, res.Code, moment)
+		assert.Equal(t, expected, res.Body.String(), moment)
+	}
+
+	clockAt(40)
+	res = serveAs(s, "POST", "/marker/1/revert", `{"revision":1}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"id":1,"user":"string3","lat":48.85,"lng":2.35,"note":"cafe on the corner","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T21:13:20Z"}`, res.Body.String())
+
+	history, _ := s.store.History("string3", 1)
+	assert.Len(t, history.Revisions, 5)
+	assert.Equal(t, revisionUpdated, history.Revisions[4].Action)
+
+	res = serveAs(s, "POST", "/marker/1/revert", `{"revision":9}`)
+	assertProblem(t, res, problemValidation, fieldError{"revision", "is not a revision of this marker"})
+	res = serveAs(s, "POST", "/marker/1/revert", `{"revision":"first"}`)
+	assertProblem(t, res, problemValidation, fieldError{"revision", "must be a positive integer"})
+	res = serveAs(s, "POST", "/marker/2/revert", `{"revision":1}`)
+	assertProblem(t, res, problemNotFound)
+	res = serveAs(s, "GET", "/marker/2/history", "")
+	assertProblem(t, res, problemNotFound)
+	res = serveAs(s, "GET", "/marker?as_of=last+week", "")
+	assertProblem(t, res, problemInvalidQuery)
+}
+
+func TestMarkerHistoryQueries(t *testing.T) {
+	s, mock := getMockServer()
+	defer s.finalize()
+
+	mock.ExpectQuery(`FROM marker_revisions r\s+JOIN markers m ON m.id = r.marker_id\s+WHERE m.username=\$1\s+AND r.marker_id=\$2\s+ORDER BY r.revision`).
+		WithArgs("string3", 4).
+		WillReturnRows(sqlmock.NewRows([]string{"revision", "action", "lat", "long", "note", "visited_at", "visited_offset", "changed_by", "changed_at"}).
+			AddRow(1, "created", 1.5, 1.5, "first", nil, nil, "string3", stubMarkerTime).
+			AddRow(2, "updated", 1.5, 1.5, "second", stubMarkerTime, 3600, "string3", stubMarkerTime.Add(time.Hour)))
+
+	res := serveAs(s, "GET", "/marker/4/history", "")
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, `{"marker_id":4,"revisions":[`+
+		`{"revision":1,"action":"created","lat":1.5,"lng":1.5,"note":"first","changed_by":"string3","changed_at":"2019-03-10T20:33:20Z"},`+
+		`{"revision":2,"action":"updated","lat":1.5,"lng":1.5,"note":"second","visited_at":"2019-03-10T21:33:20+01:00","changed_by":"string3","changed_at":"2019-03-10T21:33:20Z"}]}`,
+		res.Body.String())
+
+	asOf := time.Date(2019, time.March, 1, 0, 0, 0, 0, time.UTC)
+	mock.
+		ExpectPrepare(`(?s)FROM \(\s+SELECT DISTINCT ON \(r.marker_id\).*WHERE r.changed_at <= \$1\s+ORDER BY r.marker_id, r.revision DESC\s+\) AS markers\s+WHERE username=\$2\s+AND deleted_at IS NULL\s+ORDER BY id`).
+		ExpectQuery().
+		WithArgs(asOf, "string3").
+		WillReturnRows(markerRows())
+
+	res = serveAs(s, "GET", "/marker?as_of=2019-03-01", "")
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, `{"markers":null}`, res.Body.String())
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// legacyKeyURL serves the PEM public key of the auth service, used when no other key source is configured
+const legacyKeyURL = "https://trip-pin-points-auth.com/key"
+
+// keyProvider hands out the public keys that verify tokens, kid is the key id from the token header
+type keyProvider interface {
+	Key(kid string) (*rsa.PublicKey, error)
+}
+
+var errUnknownKey = errors.New("No key matches the token key id")
+
+// newKeyProvider picks the key source from the environment:
+// AUTH_JWKS_URL, then AUTH_PUBLIC_KEY_FILE, then AUTH_PUBLIC_KEY, falling back to the auth service PEM endpoint
+func newKeyProvider(logger *zap.Logger) (keyProvider, error) {
+	if url, ok := os.LookupEnv("AUTH_JWKS_URL"); ok {
+		interval := 15 * time.Minute
+		if raw, ok := os.LookupEnv("AUTH_JWKS_REFRESH"); ok {
+			var err error
+			if interval, err = time.ParseDuration(raw); err != nil || interval <= 0 {
+				return nil, fmt.Errorf("invalid AUTH_JWKS_REFRESH %q", raw)
+			}
+		}
+		logger.Info("Using JWKS auth keys", zap.String("url", url), zap.Duration("refresh", interval))
+		return newJWKSProvider(url, interval, logger)
+	}
+
+	if path, ok := os.LookupEnv("AUTH_PUBLIC_KEY_FILE"); ok {
+		logger.Info("Using auth key from file", zap.String("path", path))
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return newPEMKeyProvider(raw)
+	}
+
+	if raw, ok := os.LookupEnv("AUTH_PUBLIC_KEY"); ok {
+		logger.Info("Using auth key from environment")
+		return newPEMKeyProvider([]byte(raw))
+	}
+
+	logger.Info("Using auth key from auth service", zap.String("url", legacyKeyURL))
+	raw, err := fetch(legacyKeyURL)
+	if err != nil {
+		return nil, err
+	}
+	return newPEMKeyProvider(raw)
+}
+
+// staticKeyProvider verifies every token with the same key, whatever its key id
+type staticKeyProvider struct {
+	key *rsa.PublicKey
+}
+
+func newStaticKeyProvider(key *rsa.PublicKey) *staticKeyProvider {
+	return &staticKeyProvider{key: key}
+}
+
+func newPEMKeyProvider(raw []byte) (*staticKeyProvider, error) {
+	key, err := parsePublicKeyPEM(raw)
+	if err != nil {
+		return nil, err
+	}
+	return newStaticKeyProvider(key), nil
+}
+
+func (p *staticKeyProvider) Key(kid string) (*rsa.PublicKey, error) {
+	return p.key, nil
+}
+
+// parsePublicKeyPEM reads an RSA public key in either PKCS#1 (RSA PUBLIC KEY) or PKIX (PUBLIC KEY) form
+func parsePublicKeyPEM(raw []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("No PEM block found in public key")
+	}
+
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Public key is not an RSA key")
+	}
+	return key, nil
+}
+
+// jwksProvider keeps the keys of a JWKS endpoint cached by key id.
+// The set is refreshed in the background, and early when a token names a key id not seen yet,
+// so a key rotation on the auth service does not need a restart.
+type jwksProvider struct {
+	url      string
+	interval time.Duration
+	logger   *zap.Logger
+
+	mu          sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	lastRefresh time.Time
+
+	// refreshing is held during an early refresh, so requests with unknown key ids share a single fetch
+	refreshing  sync.Mutex
+	lastAttempt time.Time
+
+	stop chan struct{}
+}
+
+// minJWKSRefresh limits how often an unknown key id can trigger a refresh
+const minJWKSRefresh = 30 * time.Second
+
+func newJWKSProvider(url string, interval time.Duration, logger *zap.Logger) (*jwksProvider, error) {
+	p := &jwksProvider{
+		url:      url,
+		interval: interval,
+		logger:   logger,
+		stop:     make(chan struct{}),
+	}
+
+	if err := p.refresh(); err != nil {
+		return nil, err
+	}
+
+	go p.run()
+	return p, nil
+}
+
+func (p *jwksProvider) Key(kid string) (*rsa.PublicKey, error) {
+	p.mu.RLock()
+	key, ok := p.keys[kid]
+	p.mu.RUnlock()
+
+	if ok {
+		return key, nil
+	}
+
+	p.refreshEarly()
+
+	p.mu.RLock()
+	key, ok = p.keys[kid]
+	p.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	return nil, errUnknownKey
+}
+
+// refreshEarly refreshes the set for a key id not seen yet, unless it was fetched or tried less than minJWKSRefresh ago.
+// Concurrent callers wait for the fetch in progress instead of starting their own.
+func (p *jwksProvider) refreshEarly() {
+	p.refreshing.Lock()
+	defer p.refreshing.Unlock()
+
+	p.mu.RLock()
+	recent := time.Since(p.lastRefresh) <= minJWKSRefresh
+	p.mu.RUnlock()
+
+	if recent || time.Since(p.lastAttempt) <= minJWKSRefresh {
+		return
+	}
+
+	p.lastAttempt = time.Now()
+	if err := p.refresh(); err != nil {
+		p.logger.Error("Could not refresh JWKS", zap.Error(err))
+	}
+}
+
+// Close stops the background refresh
+func (p *jwksProvider) Close() error {
+	close(p.stop)
+	return nil
+}
+
+func (p *jwksProvider) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.refresh(); err != nil {
+				p.logger.Error("Could not refresh JWKS, keeping the previous keys", zap.Error(err))
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *jwksProvider) refresh() error {
+	raw, err := fetch(p.url)
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(raw)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.lastRefresh = time.Now()
+	p.mu.Unlock()
+
+	p.logger.Info("JWKS refreshed", zap.Int("keys", len(keys)))
+	return nil
+}
+
+// jwk is one key of a JSON Web Key Set, only RSA signing keys are used
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func parseJWKS(raw []byte) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus for key %q", k.Kid)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid exponent for key %q", k.Kid)
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no RSA signing keys")
+	}
+	return keys, nil
+}
+
+var keyClient = &http.Client{Timeout: 10 * time.Second}
+
+func fetch(url string) ([]byte, error) {
+	res, err := keyClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %d", url, res.StatusCode)
+	}
+
+	return ioutil.ReadAll(res.Body)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// testSigningKey signs the tokens minted by the tests, generated once as it is slow
+var testSigningKey struct {
+	once sync.Once
+	key  *rsa.PrivateKey
+}
+
+func getTestSigningKey() *rsa.PrivateKey {
+	testSigningKey.once.Do(func() {
+		testSigningKey.key, _ = rsa.GenerateKey(rand.Reader, 2048)
+	})
+	return testSigningKey.key
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return signed
+}
+
+func jwkFor(kid string, key *rsa.PublicKey) jwk {
+	return jwk{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func TestParsePublicKeyPEM(t *testing.T) {
+	pkcs1, err := parsePublicKeyPEM([]byte(key))
+	assert.NoError(t, err)
+
+	pkix, _ := x509.MarshalPKIXPublicKey(pkcs1)
+	parsed, err := parsePublicKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}))
+	assert.NoError(t, err)
+	assert.Equal(t, pkcs1, parsed)
+
+	_, err = parsePublicKeyPEM([]byte("not a pem"))
+	assert.EqualError(t, err, "No PEM block found in public key")
+
+	_, err = parsePublicKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("garbage")}))
+	assert.Error(t, err)
+}
+
+func TestJWKSProviderRotation(t *testing.T) {
+	first := getTestSigningKey()
+	second, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	var mu sync.Mutex
+	keys := []jwk{jwkFor("first", &first.PublicKey)}
+
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": keys})
+	}))
+	defer jwks.Close()
+
+	logger, _ := zap.NewProduction()
+	provider, err := newJWKSProvider(jwks.URL, time.Hour, logger)
+	assert.NoError(t, err)
+	defer provider.Close()
+
+	key, err := provider.Key("first")
+	assert.NoError(t, err)
+	assert.Equal(t, &first.PublicKey, key)
+
+	_, err = provider.Key("second")
+	assert.Equal(t, errUnknownKey, err)
+
+	// the auth service rotates, the unknown kid refreshes the set once the cache is old enough
+	mu.Lock()
+	keys = append(keys, jwkFor("second", &second.PublicKey))
+	mu.Unlock()
+	provider.lastRefresh = time.Now().Add(-time.Hour)
+
+	key, err = provider.Key("second")
+	assert.NoError(t, err)
+	assert.Equal(t, &second.PublicKey, key)
+}
+
+func TestJWKSProviderSharesEarlyRefresh(t *testing.T) {
+	first := getTestSigningKey()
+
+	var fetches int32
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(50 * time.Millisecond)
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {jwkFor("first", &first.PublicKey)}})
+	}))
+	defer jwks.Close()
+
+	logger, _ := zap.NewProduction()
+	provider, err := newJWKSProvider(jwks.URL, time.Hour, logger)
+	assert.NoError(t, err)
+	defer provider.Close()
+	provider.lastRefresh = time.Now().Add(-time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := provider.Key("unknown")
+			assert.Equal(t, errUnknownKey, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
+
+func TestVerifyTokenSelectsKeyByKid(t *testing.T) {
+	signing := getTestSigningKey()
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	keys, err := parseJWKS([]byte(`{"keys":[` + mustJSON(jwkFor("a", &other.PublicKey)) + `,` + mustJSON(jwkFor("b", &signing.PublicKey)) + `]}`))
+	assert.NoError(t, err)
+
+	s := getMemoryServer()
+	defer s.finalize()
+	s.keys = &jwksProvider{keys: keys, lastRefresh: time.Now(), logger: s.logger, stop: make(chan struct{})}
+
+	claims := jwt.MapClaims{"zid": "rotated", "exp": stubTokenTime.Add(time.Hour).Unix()}
+
+	user, err := s.verifyToken(signToken(t, signing, "b", claims))
+	assert.NoError(t, err)
+	assert.Equal(t, "rotated", user.ZID)
+
+	_, err = s.verifyToken(signToken(t, signing, "a", claims))
+	assert.Error(t, err)
+
+	_, err = s.verifyToken(signToken(t, signing, "c", claims))
+	assert.Error(t, err)
+}
+
+func mustJSON(v interface{}) string {
+	raw, _ := json.Marshal(v)
+	return string(raw)
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	kmlNamespace = "http://www.opengis.net/kml/2.2"
+	kmlMediaType = "application/vnd.google-earth.kml+xml"
+	kmzMediaType = "application/vnd.google-earth.kmz"
+)
+
+// kmlMarkerIcon is the pin every exported placemark is drawn with
+const kmlMarkerIcon = "https://maps.google.com/mapfiles/kml/pushpin/red-pushpin.png"
+
+// zipMagic starts every zip archive, which is how a KMZ body is told apart from plain KML
+var zipMagic = []byte("PK\x03\x04")
+
+var (
+	errNoKMLInArchive = errors.New("KMZ archive has no KML document")
+	errNotKML         = errors.New("Document root is not a kml element")
+)
+
+// kmlPlacemark is the subset of a KML Placemark that can become a marker
+type kmlPlacemark struct {
+	Name        string    `xml:"name,omitempty"`
+	Description string    `xml:"description,omitempty"`
+	StyleURL    string    `xml:"styleUrl,omitempty"`
+	Point       *kmlPoint `xml:"Point"`
+}
+
+type kmlPoint struct {
+	// Coordinates is longitude,latitude with an optional altitude
+	Coordinates string `xml:"coordinates"`
+}
+
+// kmlFolder groups the imported markers of one KML Folder, by their position in the import
+type kmlFolder struct {
+	Name    string
+	Markers []int
+}
+
+// kmlImport is what a KML document holds, folders only list the placemarks directly inside them
+type kmlImport struct {
+	Markers []Marker
+	Folders []kmlFolder
+}
+
+// readKML streams placemarks with a point out of a KML document, other geometries are skipped.
+// It stops as soon as the document has more placemarks than an import accepts.
+func readKML(body io.Reader, user string) (*kmlImport, error) {
+	decoder := xml.NewDecoder(body)
+	result := &kmlImport{}
+
+	// open holds the folders being read, the innermost last
+	var open []*kmlFolder
+	// parents are the names of the elements enclosing the current token
+	var parents []string
+	var sawRoot bool
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			if len(parents) == 0 {
+				if element.Name.Local != "kml" {
+					return nil, errNotKML
+				}
+				sawRoot = true
+			}
+
+			switch {
+			case element.Name.Local == "Placemark":
+				var placemark kmlPlacemark
+				if err = decoder.DecodeElement(&placemark, &element); err != nil {
+					return nil, err
+				}
+				if placemark.Point == nil {
+					continue
+				}
+				marker, err := placemark.marker(user)
+				if err != nil {
+					return nil, err
+				}
+				if len(open) > 0 {
+					folder := open[len(open)-1]
+					folder.Markers = append(folder.Markers, len(result.Markers))
+				}
+				result.Markers = append(result.Markers, *marker)
+				if len(result.Markers) > maxImportMarkers {
+					return result, nil
+				}
+				continue
+			case element.Name.Local == "name" && len(parents) > 0 && parents[len(parents)-1] == "Folder":
+				if err = decoder.DecodeElement(&open[len(open)-1].Name, &element); err != nil {
+					return nil, err
+				}
+				continue
+			case element.Name.Local == "Folder":
+				open = append(open, &kmlFolder{})
+			}
+			parents = append(parents, element.Name.Local)
+		case xml.EndElement:
+			parents = parents[:len(parents)-1]
+			if element.Name.Local == "Folder" {
+				folder := open[len(open)-1]
+				open = open[:len(open)-1]
+				if len(folder.Markers) > 0 {
+					result.Folders = append(result.Folders, *folder)
+				}
+			}
+		}
+	}
+
+	if !sawRoot {
+		return nil, errNotKML
+	}
+	return result, nil
+}
+
+// marker turns a placemark into a marker of user, its note joins the name and description
+func (p *kmlPlacemark) marker(user string) (*Marker, error) {
+	parts := strings.Split(strings.TrimSpace(p.Point.Coordinates), ",")
+	if len(parts) < 2 {
+		return nil, errors.New("Point coordinates must be longitude,latitude")
+	}
+
+	lng, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return nil, err
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Marker{User: user, Lat: lat, Lng: lng, Note: gpxNote(gpxPoint{Name: p.Name, Desc: p.Description})}, nil
+}
+
+// openKMLBody returns the KML document of an import body, which may also be a KMZ archive.
+// Archives need random access, so they are spooled to a temporary file that cleanup removes.
+func openKMLBody(body io.Reader) (document io.Reader, cleanup func(), err error) {
+	buffered := bufio.NewReader(body)
+	cleanup = func() {}
+
+	if magic, _ := buffered.Peek(len(zipMagic)); !bytes.Equal(magic, zipMagic) {
+		return buffered, cleanup, nil
+	}
+
+	spool, err := ioutil.TempFile("", "import-*.kmz")
+	if err != nil {
+		return nil, cleanup, err
+	}
+	cleanup = func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}
+
+	size, err := io.Copy(spool, buffered)
+	if err != nil {
+		return nil, cleanup, err
+	}
+
+	archive, err := zip.NewReader(spool, size)
+	if err != nil {
+		return nil, cleanup, err
+	}
+
+	// Google Earth reads the first .kml file of the archive, doc.kml by convention
+	for _, file := range archive.File {
+		if strings.EqualFold(path.Ext(file.Name), ".kml") {
+			document, err := file.Open()
+			if err != nil {
+				return nil, cleanup, err
+			}
+			closeSpool := cleanup
+			cleanup = func() {
+				document.Close()
+				closeSpool()
+			}
+			return document, cleanup, nil
+		}
+	}
+	return nil, cleanup, errNoKMLInArchive
+}
+
+// kmlImported is the answer to a KML import, with a trip for every folder that held markers
+type kmlImported struct {
+	Markers []Marker `json:"markers"`
+	Trips   []Trip   `json:"trips"`
+}
+
+// folderTrips turns every folder into a trip to create along with the imported markers
+func folderTrips(user string, folders []kmlFolder) []TripImport {
+	trips := make([]TripImport, len(folders))
+
+	for i, folder := range folders {
+		trips[i] = TripImport{Trip: Trip{User: user, Name: strings.TrimSpace(folder.Name)}, Markers: folder.Markers}
+		if trips[i].Trip.Name == "" {
+			trips[i].Trip.Name = "Imported folder"
+		}
+	}
+	return trips
+}
+
+// kmlArchive tells whether an export was asked as KMZ, by the format query or the Accept header
+func kmlArchive(r *http.Request) (bool, error) {
+	switch r.URL.Query().Get("format") {
+	case "kmz":
+		return true, nil
+	case "kml":
+		return false, nil
+	case "":
+	default:
+		return false, errors.New("format must be kml or kmz")
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted)); err == nil && mediaType == kmzMediaType {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// writeKML streams markers as KML placemarks sharing a single pin style
+func writeKML(w io.Writer, source *exportSource) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+
+	root := xml.StartElement{Name: xml.Name{Local: "kml"}, Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: kmlNamespace}}}
+	document := xml.StartElement{Name: xml.Name{Local: "Document"}}
+
+	if err := encoder.EncodeToken(root); err != nil {
+		return err
+	}
+	if err := encoder.EncodeToken(document); err != nil {
+		return err
+	}
+	if err := encoder.EncodeElement(source.Name, xml.StartElement{Name: xml.Name{Local: "name"}}); err != nil {
+		return err
+	}
+	if err := encoder.EncodeElement(newKMLStyle(), xml.StartElement{Name: xml.Name{Local: "Style"}}); err != nil {
+		return err
+	}
+
+	err := source.each(func(m *Marker) error {
+		placemark := kmlPlacemark{
+			Name:     noteTitle(m.Note),
+			StyleURL: "#marker",
+			Point:    &kmlPoint{Coordinates: formatCoordinate(m.Lng) + "," + formatCoordinate(m.Lat)},
+		}
+		if m.Note != placemark.Name {
+			placemark.Description = m.Note
+		}
+		return encoder.EncodeElement(placemark, xml.StartElement{Name: xml.Name{Local: "Placemark"}})
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := encoder.EncodeToken(document.End()); err != nil {
+		return err
+	}
+	if err := encoder.EncodeToken(root.End()); err != nil {
+		return err
+	}
+	return encoder.Flush()
+}
+
+type kmlStyle struct {
+	ID   string `xml:"id,attr"`
+	Icon struct {
+		Scale float64 `xml:"scale"`
+		Href  string  `xml:"Icon>href"`
+	} `xml:"IconStyle"`
+}
+
+func newKMLStyle() *kmlStyle {
+	style := &kmlStyle{ID: "marker"}
+	style.Icon.Scale = 1.1
+	style.Icon.Href = kmlMarkerIcon
+	return style
+}
+
+func formatCoordinate(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func (s *server) handleImportKML() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		document, cleanup, err := openKMLBody(http.MaxBytesReader(w, r.Body, maxImportSize))
+		defer cleanup()
+		if err != nil {
+			s.writeProblem(w, r, problemInvalidBody, "Body must be a valid KML document or KMZ archive", err)
+			return
+		}
+
+		content, err := readKML(document, userZid)
+		if err != nil {
+			s.writeProblem(w, r, problemInvalidBody, "Body must be a valid KML document or KMZ archive", err)
+			return
+		}
+
+		if err = validateImported(content.Markers); err != nil {
+			s.writeImportError(w, r, err)
+			return
+		}
+
+		folders := folderTrips(userZid, content.Folders)
+		if err = s.trips.ImportTrips(content.Markers, folders); err != nil {
+			s.writeImportError(w, r, err)
+			return
+		}
+
+		trips := make([]Trip, len(folders))
+		for i := range folders {
+			trips[i] = folders[i].Trip
+		}
+		writeJSON(w, http.StatusCreated, &kmlImported{Markers: content.Markers, Trips: trips})
+	}
+}
+
+func (s *server) handleExportKML() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		tripID, err := getExportTrip(r.URL.Query())
+		if err != nil {
+			s.writeProblem(w, r, problemInvalidQuery, err.Error(), err)
+			return
+		}
+
+		archive, err := kmlArchive(r)
+		if err != nil {
+			s.writeProblem(w, r, problemInvalidQuery, err.Error(), err)
+			return
+		}
+
+		source, err := s.openExport(userZid, tripID)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		w.Header().Add("Vary", "Accept")
+
+		if !archive {
+			writeAttachment(w, kmlMediaType, "markers.kml")
+			if err = writeKML(w, source); err != nil {
+				s.logger.Info("Could not write KML export", zap.Error(err))
+			}
+			return
+		}
+
+		writeAttachment(w, kmzMediaType, "markers.kmz")
+		zipped := zip.NewWriter(w)
+		document, err := zipped.Create("doc.kml")
+		if err == nil {
+			err = writeKML(document, source)
+		}
+		if err == nil {
+			err = zipped.Close()
+		}
+		if err != nil {
+			s.logger.Info("Could not write KMZ export", zap.Error(err))
+		}
+	}
+}
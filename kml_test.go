@@ -0,0 +1,184 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+const kmlSample = `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2">
+  <Document>
+    <name>Portugal 2018</name>
+    <Placemark><name>Airport</name><Point><coordinates>-9.1359,38.7742,0</coordinates></Point></Placemark>
+    <Folder>
+      <name>Lisbon</name>
+      <Placemark>
+        <name>Belem tower</name>
+        <description>Go early</description>
+        <Point><coordinates>
+          -9.2160,38.6916,0
+        </coordinates></Point>
+      </Placemark>
+      <Placemark><name>Walk</name><LineString><coordinates>-9.1,38.7 -9.2,38.7</coordinates></LineString></Placemark>
+      <Folder>
+        <name>Food</name>
+        <Placemark><name>Pasteis</name><Point><coordinates>-9.2033,38.6975</coordinates></Point></Placemark>
+      </Folder>
+      <Placemark><name>Alfama</name><Point><coordinates>-9.1300,38.7115</coordinates></Point></Placemark>
+    </Folder>
+  </Document>
+</kml>`
+
+func TestMemoryImportKML(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	res := serveAs(s, "POST", "/import/kml", kmlSample)
+	assert.Equal(t, http.StatusCreated, res.Code)
+	assert.Equal(t, `{"markers":[`+
+		`{"id":1,"user":"string3","lat":38.7742,"lng":-9.1359,"note":"Airport","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"},`+
+		`{"id":2,"user":"string3","lat":38.6916,"lng":-9.216,"note":"Belem tower\nGo early","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"},`+
+		`{"id":3,"user":"string3","lat":38.6975,"lng":-9.2033,"note":"Pasteis","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"},`+
+		`{"id":4,"user":"string3","lat":38.7115,"lng":-9.13,"note":"Alfama","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}],`+
+		`"trips":[{"id":1,"user":"string3","name":"Food","description":"","visibility":"members"},{"id":2,"user":"string3","name":"Lisbon","description":"","visibility":"members"}]}`, res.Body.String())
+
+	lisbon, _ := s.trips.TripMarkers("string3", 2)
+	assert.Len(t, lisbon, 2)
+	assert.Equal(t, "Alfama", lisbon[1].Note)
+}
+
+func TestImportKMLRollsBackOnFailure(t *testing.T) {
+	s, mock := getMockServer()
+	defer s.finalize()
+
+	mock.ExpectBegin()
+	for id := int64(1); id <= 4; id++ {
+		mock.ExpectQuery("INSERT INTO markers").WillReturnRows(insertedRow(id))
+	}
+	mock.ExpectQuery("INSERT INTO trips").
+		WithArgs("string3", "Food", "", nil, nil, nil, "members").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec("INSERT INTO trip_markers").
+		WithArgs(1, sqlmock.AnyArg()).
+		WillReturnError(errors.New("test error"))
+	mock.ExpectRollback()
+
+	res := serveAs(s, "POST", "/import/kml", kmlSample)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assertProblem(t, res, problemStorage)
+}
+
+func TestMemoryImportKMZ(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	var archive bytes.Buffer
+	zipped := zip.NewWriter(&archive)
+	image, _ := zipped.Create("images/icon.png")
+	image.Write([]byte("not really a png"))
+	document, _ := zipped.Create("doc.kml")
+	document.Write([]byte(kmlSample))
+	zipped.Close()
+
+	res := serveAs(s, "POST", "/import/kml", archive.String())
+	assert.Equal(t, http.StatusCreated, res.Code)
+
+	markers, _ := s.store.List("string3", MarkerFilter{})
+	assert.Len(t, markers.Markers, 4)
+}
+
+func TestMemoryImportInvalidKML(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	bodies := []struct {
+		body   string
+		kind   problemType
+		errors []fieldError
+	}{
+		{`{"lat":1,"lng":2}`, problemInvalidBody, nil},
+		{`<gpx><wpt lat="1" lon="2"/></gpx>`, problemInvalidBody, nil},
+		{`<kml><Placemark><Point><coordinates>1</coordinates></Point></Placemark></kml>`, problemInvalidBody, nil},
+		{`<kml><Placemark><Point><coordinates>200,10</coordinates></Point></Placemark></kml>`, problemValidation, []fieldError{{"markers[0].lng", "must be between -180 and 180"}}},
+		{"PK\x03\x04 broken archive", problemInvalidBody, nil},
+	}
+
+	for _, tt := range bodies {
+		res := serveAs(s, "POST", "/import/kml", tt.body)
+		assertProblem(t, res, tt.kind, tt.errors...)
+	}
+}
+
+func TestMemoryExportKML(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	s.store.Insert(&Marker{User: "string3", Lat: 38.6916, Lng: -9.216, Note: "Belem tower\nGo early"})
+	s.store.Insert(&Marker{User: "string3", Lat: 38.7115, Lng: -9.13, Note: "Alfama"})
+
+	expected := `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2">
+  <Document>
+    <name>Markers of string3</name>
+    <Style id="marker">
+      <IconStyle>
+        <scale>1.1</scale>
+        <Icon>
+          <href>https://maps.google.com/mapfiles/kml/pushpin/red-pushpin.png</href>
+        </Icon>
+      </IconStyle>
+    </Style>
+    <Placemark>
+      <name>Belem tower</name>
+      <description>Belem tower&#xA;Go early</description>
+      <styleUrl>#marker</styleUrl>
+      <Point>
+        <coordinates>-9.216,38.6916</coordinates>
+      </Point>
+    </Placemark>
+    <Placemark>
+      <name>Alfama</name>
+      <styleUrl>#marker</styleUrl>
+      <Point>
+        <coordinates>-9.13,38.7115</coordinates>
+      </Point>
+    </Placemark>
+  </Document>
+</kml>`
+
+	res := serveAs(s, "GET", "/export/kml", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "application/vnd.google-earth.kml+xml", res.Header().Get("Content-Type"))
+	assert.Equal(t, expected, res.Body.String())
+
+	res = serveAs(s, "GET", "/export/kml?format=kmz", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "application/vnd.google-earth.kmz", res.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="markers.kmz"`, res.Header().Get("Content-Disposition"))
+
+	archive, err := zip.NewReader(bytes.NewReader(res.Body.Bytes()), int64(res.Body.Len()))
+	assert.NoError(t, err)
+	assert.Len(t, archive.File, 1)
+	assert.Equal(t, "doc.kml", archive.File[0].Name)
+
+	document, _ := archive.File[0].Open()
+	content, _ := ioutil.ReadAll(document)
+	assert.Equal(t, expected, string(content))
+
+	roundTrip, err := readKML(bytes.NewReader(content), "string3")
+	assert.NoError(t, err)
+	assert.Equal(t, []Marker{
+		{User: "string3", Lat: 38.6916, Lng: -9.216, Note: "Belem tower\nGo early"},
+		{User: "string3", Lat: 38.7115, Lng: -9.13, Note: "Alfama"},
+	}, roundTrip.Markers)
+
+	res = serveAs(s, "GET", "/export/kml?format=shp", "")
+	assertProblem(t, res, problemInvalidQuery)
+}
@@ -1,15 +1,14 @@
 package main
 
 import (
-	"crypto/rsa"
-	"crypto/x509"
 	"database/sql"
-	"encoding/pem"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/rs/cors"
 
@@ -20,10 +19,15 @@ import (
 )
 
 type server struct {
-	db      *sql.DB
-	router  *mux.Router
-	logger  *zap.Logger
-	authKey *rsa.PublicKey
+	store    MarkerStore
+	trips    TripStore
+	shares   ShareStore
+	profiles ProfileStore
+	router   *mux.Router
+	logger   *zap.Logger
+	keys     keyProvider
+	auth     authConfig
+	purger   *trashPurger
 }
 
 func newServer() *server {
@@ -36,91 +40,158 @@ func newServer() *server {
 		log.Fatalf("Failed to initialize zap logger: %v", err)
 	}
 
-	res, err := http.Get("https://trip-pin-points-auth.com/key")
-	if err != nil {
-		s.logger.Fatal("Failed to get authorization key", zap.Error(err))
+	if s.keys, err = newKeyProvider(s.logger); err != nil {
+		s.logger.Fatal("Failed to load authorization keys", zap.Error(err))
 	}
 
-	bodyBytes, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		s.logger.Fatal("Failed to read public key from auth service", zap.Error(err))
+	if s.auth, err = newAuthConfig(); err != nil {
+		s.logger.Fatal("Invalid authorization settings", zap.Error(err))
 	}
-	block, _ := pem.Decode(bodyBytes)
 
-	if s.authKey, err = x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
-		s.logger.Fatal("Failed to parse public key", zap.Error(err))
+	if store, ok := os.LookupEnv("MARKER_STORE"); ok && store == "memory" {
+		s.logger.Info("Using in-memory marker store, markers will be lost on restart")
+		store := newMemoryStore()
+		s.store, s.trips, s.shares, s.profiles = store, store, store, store
+	} else {
+		s.startDatabase()
 	}
 
-	s.startDatabase()
+	if s.purger, err = newTrashPurger(s.store, s.logger); err != nil {
+		s.logger.Fatal("Invalid trash settings", zap.Error(err))
+	}
+	s.purger.start()
 
 	return &s
 }
 
 func (s *server) startDatabase() {
+	db := openDatabase(s.logger)
+
+	applied, err := newMigrator(db).up()
+	if err != nil {
+		s.logger.Fatal("Could not migrate database", zap.Error(err))
+	}
+	s.logger.Info("Database migrated", zap.Int("applied", applied))
+
+	store := newPostgresStore(db)
+	s.store, s.trips, s.shares, s.profiles = store, store, store, store
+}
+
+func openDatabase(logger *zap.Logger) *sql.DB {
+	var db *sql.DB
 	var host, port, user, password, dbname string
 	var ok bool
 	var err error
 
 	if host, ok = os.LookupEnv("RDS_HOSTNAME"); !ok {
-		s.logger.Fatal("Failed to find host environment variable")
+		logger.Fatal("Failed to find host environment variable")
 	}
 
 	if port, ok = os.LookupEnv("RDS_PORT"); !ok {
-		s.logger.Fatal("Failed to find port environment variable")
+		logger.Fatal("Failed to find port environment variable")
 	}
 
 	if user, ok = os.LookupEnv("RDS_USERNAME"); !ok {
-		s.logger.Fatal("Failed to find user environment variable")
+		logger.Fatal("Failed to find user environment variable")
 	}
 
 	if password, ok = os.LookupEnv("RDS_PASSWORD"); !ok {
-		s.logger.Fatal("Failed to find password environment variable")
+		logger.Fatal("Failed to find password environment variable")
 	}
 
 	if dbname, ok = os.LookupEnv("RDS_DB_NAME"); !ok {
-		s.logger.Fatal("Failed to find dbname environment variable")
+		logger.Fatal("Failed to find dbname environment variable")
 	}
 
 	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s "+
 		"password=%s dbname=%s sslmode=disable",
 		host, port, user, password, dbname)
 
-	s.logger.Info("Trying to connect to", zap.String("connstring", psqlInfo))
+	logger.Info("Trying to connect to", zap.String("connstring", psqlInfo))
 
-	if s.db, err = sql.Open("postgres", psqlInfo); err != nil {
-		s.logger.Fatal("Failed to initialize databse")
+	if db, err = sql.Open("postgres", psqlInfo); err != nil {
+		logger.Fatal("Failed to initialize databse")
 	}
 
-	err = s.db.Ping()
+	err = db.Ping()
 	if err != nil {
-		s.logger.Fatal("Failed to ping database")
+		logger.Fatal("Failed to ping database")
 	}
 
-	s.logger.Info("Database connected !")
+	logger.Info("Database connected !")
+
+	return db
+}
 
-	_, err = s.db.Exec(`
-	CREATE TABLE IF NOT EXISTS markers 
-	(
-		id SERIAL PRIMARY KEY,
-		username TEXT NOT NULL,
-		lat DOUBLE PRECISION NOT NULL,
-		long DOUBLE PRECISION NOT NULL,
-		note TEXT
-	);`)
+func (s *server) finalize() {
+	s.logger.Sync()
+	if s.purger != nil {
+		s.purger.Close()
+	}
+	s.store.Close()
+	if closer, ok := s.keys.(io.Closer); ok {
+		closer.Close()
+	}
+}
 
+// migrate runs the schema migrations without starting the service.
+// Usage: application migrate [up | down [steps] | status]
+func migrate(args []string) {
+	logger, err := zap.NewProduction()
 	if err != nil {
-		s.logger.Fatal("Could not create initial table", zap.Error(err))
+		log.Fatalf("Failed to initialize zap logger: %v", err)
 	}
+	defer logger.Sync()
 
-	return
-}
+	db := openDatabase(logger)
+	defer db.Close()
 
-func (s *server) finalize() {
-	s.logger.Sync()
-	s.db.Close()
+	m := newMigrator(db)
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		applied, err := m.up()
+		if err != nil {
+			logger.Fatal("Could not migrate database", zap.Error(err))
+		}
+		logger.Info("Database migrated", zap.Int("applied", applied))
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				logger.Fatal("Invalid number of steps to revert", zap.String("steps", args[1]))
+			}
+		}
+		reverted, err := m.down(steps)
+		if err != nil {
+			logger.Fatal("Could not revert migrations", zap.Error(err))
+		}
+		logger.Info("Migrations reverted", zap.Int("reverted", reverted))
+	case "status":
+		applied, err := m.status()
+		if err != nil {
+			logger.Fatal("Could not read migrations", zap.Error(err))
+		}
+		for _, a := range applied {
+			fmt.Printf("%d\t%s\t%s\n", a.Version, a.Name, a.AppliedAt.Format(time.RFC3339))
+		}
+		fmt.Printf("%d of %d migrations applied\n", len(applied), len(migrations))
+	default:
+		logger.Fatal("Unknown migrate command, use up, down or status", zap.String("command", command))
+	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
+
 	s := newServer()
 	defer s.finalize()
 
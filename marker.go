@@ -1,111 +1,90 @@
 package main
 
-import (
-	"database/sql"
-	"errors"
-)
+import "time"
 
 // MarkerCollection represents a collection of many markers all of the same user
 type MarkerCollection struct {
 	Markers []Marker `json:"markers"`
+
+	// NextCursor fetches the following page when the collection was paginated and has more markers
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 // Marker represents a marker in the trip pin points
 type Marker struct {
-	User string  `json:"user"`
+	ID   int64   `json:"id"`
+	User string  `json:"user,omitempty"`
 	Lat  float64 `json:"lat"`
 	Lng  float64 `json:"lng"`
 	Note string  `json:"note"`
-}
 
-func (m *Marker) save(db *sql.DB) error {
-	sqlStatement := `
-	INSERT INTO markers (username, lat, long, note)
-	VALUES ($1, $2, $3, $4)
-	`
-	_, err := db.Exec(sqlStatement, m.User, m.Lat, m.Lng, m.Note)
+	// Visibility tells who besides its owner can see the marker
+	Visibility string `json:"visibility"`
 
-	return err
-}
-
-func getMarkerCollection(user string, db *sql.DB) (*MarkerCollection, error) {
+	// VisitedAt is when the user was at the marker, given by the user in their own time zone
+	VisitedAt *time.Time `json:"visited_at,omitempty"`
+	// CreatedAt and UpdatedAt are maintained by the store
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// DeletedAt is when the marker was moved to the trash, only set on trashed markers
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 
-	sqlStatement := `
-	SELECT * FROM markers 
-	WHERE username=$1
-	`
+	// Distance in meters from the point of a nearby search, only set on its results
+	Distance *float64 `json:"distance,omitempty"`
 
-	stmt, _ := db.Prepare(sqlStatement)
-	rows, err := stmt.Query(user)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	// ChangedBy is the trip member updating a marker of someone else, recorded in its revisions
+	ChangedBy string `json:"-"`
+}
 
-	var markerColelction MarkerCollection
-	var note, dbUser string
-	var lat, lng float64
-	var id int
+// Visibilities of markers and trips. Private ones are only seen by their owner, members ones also by
+// the members of the trips they belong to and public ones by anyone, on the public profile of their owner.
+const (
+	visibilityPrivate = "private"
+	visibilityMembers = "members"
+	visibilityPublic  = "public"
+)
 
-	for rows.Next() {
-		err := rows.Scan(&id, &dbUser, &lat, &lng, &note)
-		if err != nil {
-			return nil, err
-		}
-		marker := Marker{Lat: lat, Lng: lng, Note: note, User: dbUser}
-		markerColelction.Markers = append(markerColelction.Markers, marker)
-	}
+// visibilities are the valid values of a visibility
+var visibilities = map[string]bool{visibilityPrivate: true, visibilityMembers: true, visibilityPublic: true}
 
-	err = rows.Err()
-	if err != nil {
-		return nil, err
+// visibilityOrDefault is the visibility of a marker or trip saved without one
+func visibilityOrDefault(visibility string) string {
+	if visibility == "" {
+		return visibilityMembers
 	}
-	return &markerColelction, nil
+	return visibility
 }
 
-func getMarker(user string, lat string, lng string, db *sql.DB) (*Marker, error) {
-
-	sqlStatement := `
-	SELECT * FROM markers 
-	WHERE username=$1
-	AND lat=$2
-	AND long=$3
-	`
-
-	stmt, _ := db.Prepare(sqlStatement)
-	row := stmt.QueryRow(user, lat, lng)
-
-	var note, dbUser string
-	var resultLat, resultLng float64
-	var id int
-
-	err := row.Scan(&id, &dbUser, &resultLat, &resultLng, &note)
-
-	if err != nil {
-		return nil, err
+// changer is who an update of m is recorded as made by
+func (m *Marker) changer() string {
+	if m.ChangedBy != "" {
+		return m.ChangedBy
 	}
-
-	return &Marker{Lat: resultLat, Lng: resultLng, Note: note, User: dbUser}, nil
+	return m.User
 }
 
-func deleteMarker(user string, lat string, lng string, db *sql.DB) error {
-
-	sqlStatement := `
-	DELETE FROM markers
-	WHERE username=$1
-	AND lat=$2
-	AND long=$3
-	`
-	result, err := db.Exec(sqlStatement, user, lat, lng)
-
-	if err != nil {
-		return err
-	}
+// Actions a MarkerRevision records
+const (
+	revisionCreated  = "created"
+	revisionUpdated  = "updated"
+	revisionDeleted  = "deleted"
+	revisionRestored = "restored"
+)
 
-	rowsAffected, _ := result.RowsAffected()
+// MarkerHistory is every revision of a marker, oldest first
+type MarkerHistory struct {
+	MarkerID  int64            `json:"marker_id"`
+	Revisions []MarkerRevision `json:"revisions"`
+}
 
-	if rowsAffected == 0 {
-		return errors.New("Could not find marker to delete")
-	}
-	return nil
+// MarkerRevision is the immutable state of a marker right after one change to it
+type MarkerRevision struct {
+	Revision  int64      `json:"revision"`
+	Action    string     `json:"action"`
+	Lat       float64    `json:"lat"`
+	Lng       float64    `json:"lng"`
+	Note      string     `json:"note"`
+	VisitedAt *time.Time `json:"visited_at,omitempty"`
+	ChangedBy string     `json:"changed_by"`
+	ChangedAt time.Time  `json:"changed_at"`
 }
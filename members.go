@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+func (s *server) handleGetTripMembers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		id, err := getTripID(mux.Vars(r))
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find trip", err)
+			return
+		}
+
+		if _, err = s.tripAccess(userZid, id, roleViewer); err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		members, err := s.trips.TripMembers(id)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, members)
+	}
+}
+
+// handleUpdateTripMember lets owners change the role of a member, the creator of a trip always stays an owner
+func (s *server) handleUpdateTripMember() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		params := mux.Vars(r)
+		id, err := getTripID(params)
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find trip", err)
+			return
+		}
+
+		access, err := s.tripAccess(userZid, id, roleOwner)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		member := TripMember{User: params["zid"]}
+		if member.Role, err = getMemberRole(r.Body); err != nil {
+			s.writeBodyError(w, r, err)
+			return
+		}
+
+		if member.User == access.Creator {
+			errs := &validationError{}
+			errs.add("role", "can not be changed for the creator of the trip")
+			s.writeBodyError(w, r, errs)
+			return
+		}
+
+		if err = s.trips.UpdateTripMember(id, member); err != nil {
+			s.writeStoreError(w, r, err, "Could not find member of this trip")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, member)
+	}
+}
+
+// handleRemoveTripMember lets owners remove members and members leave a trip
+func (s *server) handleRemoveTripMember() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		params := mux.Vars(r)
+		id, err := getTripID(params)
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find trip", err)
+			return
+		}
+
+		role := roleOwner
+		if params["zid"] == userZid {
+			role = roleViewer
+		}
+
+		if _, err = s.tripAccess(userZid, id, role); err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		if err = s.trips.RemoveTripMember(id, params["zid"]); err != nil {
+			s.writeStoreError(w, r, err, "Could not find member of this trip")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *server) handleGetTripInvitations() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		id, err := getTripID(mux.Vars(r))
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find trip", err)
+			return
+		}
+
+		if _, err = s.tripAccess(userZid, id, roleOwner); err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		invitations, err := s.trips.TripInvitations(id)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, invitations)
+	}
+}
+
+// handleInsertInvitation lets owners invite a user to the trip by their zid
+func (s *server) handleInsertInvitation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		id, err := getTripID(mux.Vars(r))
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find trip", err)
+			return
+		}
+
+		if _, err = s.tripAccess(userZid, id, roleOwner); err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		inv, err := getNewInvitation(r.Body, id, userZid)
+		if err != nil {
+			s.writeBodyError(w, r, err)
+			return
+		}
+
+		members, err := s.trips.TripMembers(id)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+		for _, member := range members.Members {
+			if member.User == inv.User {
+				errs := &validationError{}
+				errs.add("zid", "is already a member of this trip")
+				s.writeBodyError(w, r, errs)
+				return
+			}
+		}
+
+		if err = s.trips.InsertInvitation(inv); err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, inv)
+	}
+}
+
+// handleGetInvitations lists the invitations waiting for the user of the request
+func (s *server) handleGetInvitations() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		invitations, err := s.trips.Invitations(userZid)
+		if err != nil {
+			s.writeStoreError(w, r, err, "")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, invitations)
+	}
+}
+
+// handleAcceptInvitation makes the invited user a member and answers with the trip they joined
+func (s *server) handleAcceptInvitation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		inv, err := s.invitationOf(userZid, mux.Vars(r), false)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find invitation")
+			return
+		}
+
+		if err = s.trips.AcceptInvitation(inv.ID); err != nil {
+			s.writeStoreError(w, r, err, "Could not find invitation")
+			return
+		}
+
+		access, err := s.tripAccess(userZid, inv.TripID, roleViewer)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		trip, err := s.tripWithMarkers(access.Creator, inv.TripID, userZid)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find trip")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, trip)
+	}
+}
+
+// handleDeleteInvitation lets the invited user decline an invitation and the owners of the trip withdraw it
+func (s *server) handleDeleteInvitation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		inv, err := s.invitationOf(userZid, mux.Vars(r), true)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find invitation")
+			return
+		}
+
+		if err = s.trips.DeleteInvitation(inv.ID); err != nil {
+			s.writeStoreError(w, r, err, "Could not find invitation")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// invitationOf finds the invitation of the request when it was sent to user,
+// or when byOwners is set and user is one of the owners of its trip
+func (s *server) invitationOf(user string, params map[string]string, byOwners bool) (*Invitation, error) {
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		return nil, errInvitationNotFound
+	}
+
+	inv, err := s.trips.GetInvitation(id)
+	if err != nil {
+		return nil, err
+	}
+	if inv.User == user {
+		return inv, nil
+	}
+
+	if byOwners {
+		if _, err = s.tripAccess(user, inv.TripID, roleOwner); err == nil {
+			return inv, nil
+		}
+	}
+	return nil, errInvitationNotFound
+}
+
+// getNewInvitation reads the zid and role of a user to invite to a trip
+func getNewInvitation(body io.Reader, tripID int64, invitedBy string) (*Invitation, error) {
+
+	fields, err := decodeObject(body)
+	if err != nil {
+		return nil, err
+	}
+
+	inv := Invitation{TripID: tripID, InvitedBy: invitedBy}
+	errs := &validationError{}
+
+	value, ok := fields["zid"]
+	if !ok || isJSONNull(value) {
+		errs.add("zid", "is required")
+	} else if err = json.Unmarshal(value, &inv.User); err != nil {
+		errs.add("zid", "must be a string")
+	} else if strings.TrimSpace(inv.User) == "" {
+		errs.add("zid", "must not be blank")
+	}
+
+	inv.Role = readRole(fields, errs)
+
+	if err = errs.orNil(); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func getMemberRole(body io.Reader) (string, error) {
+
+	fields, err := decodeObject(body)
+	if err != nil {
+		return "", err
+	}
+
+	errs := &validationError{}
+	role := readRole(fields, errs)
+
+	if err = errs.orNil(); err != nil {
+		return "", err
+	}
+	return role, nil
+}
+
+// readRole reads the required role field of a body
+func readRole(fields map[string]json.RawMessage, errs *validationError) string {
+	value, ok := fields["role"]
+	if !ok || isJSONNull(value) {
+		errs.add("role", "is required")
+		return ""
+	}
+
+	var role string
+	if err := json.Unmarshal(value, &role); err != nil || tripRoles[role] == 0 {
+		errs.add("role", "must be one of owner, editor and viewer")
+	}
+	return role
+}
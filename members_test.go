@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryJoinTripAsEditor(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	s.store.Insert(&Marker{User: "someone-else", Lat: 48.85, Lng: 2.35, Note: "paris"})
+	s.store.Insert(&Marker{User: "string3", Lat: 45.76, Lng: 4.83, Note: "lyon"})
+	s.store.Insert(&Marker{User: "someone-else", Lat: 40.41, Lng: -3.7, Note: "madrid"})
+	s.trips.InsertTrip(&Trip{User: "someone-else", Name: "Family trip"})
+	s.trips.SetTripMarkers("someone-else", 1, "someone-else", []int64{1})
+	s.trips.InsertInvitation(&Invitation{TripID: 1, User: "string3", Role: roleEditor, InvitedBy: "someone-else"})
+
+	res := serveAs(s, "GET", "/trip/1", "")
+	assertProblem(t, res, problemNotFound)
+
+	res = serveAs(s, "GET", "/invitation", "")
+	assert.Equal(t, `{"invitations":[{"id":1,"trip_id":1,"zid":"string3","role":"editor","invited_by":"someone-else","created_at":"2019-03-10T20:33:20Z"}]}`, res.Body.String())
+
+	res = serveAs(s, "POST", "/invitation/1/accept", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"id":1,"user":"someone-else","name":"Family trip","description":"","visibility":"members","markers":[{"id":1,"user":"someone-else","lat":48.85,"lng":2.35,"note":"paris","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}]}`, res.Body.String())
+
+	res = serveAs(s, "GET", "/trip", "")
+	assert.Equal(t, `{"trips":[{"id":1,"user":"someone-else","name":"Family trip","description":"","visibility":"members"}]}`, res.Body.String())
+	res = serveAs(s, "GET", "/trip/1/members", "")
+	assert.Equal(t, `{"members":[{"zid":"someone-else","role":"owner"},{"zid":"string3","role":"editor"}]}`, res.Body.String())
+
+	res = serveAs(s, "PATCH", "/trip/1/markers/1", `{"note":"paris, day one"}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	history, _ := s.store.History("someone-else", 1)
+	assert.Equal(t, "string3", history.Revisions[1].ChangedBy)
+	assert.Equal(t, "paris, day one", history.Revisions[1].Note)
+	res = serveAs(s, "PATCH", "/trip/1/markers/1", `{"visibility":"public"}`)
+	assertProblem(t, res, problemValidation, fieldError{"visibility", "can only be changed by the owner of the marker"})
+	res = serveAs(s, "PATCH", "/trip/1/markers/1", `{"visibility":"members"}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	res = serveAs(s, "PUT", "/trip/1/markers", `{"marker_ids":[1,2]}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	res = serveAs(s, "PUT", "/trip/1/markers", `{"marker_ids":[1,2,3]}`)
+	assertProblem(t, res, problemValidation, fieldError{"marker_ids", "must only contain your markers"})
+	res = serveAs(s, "PATCH", "/trip/1/markers/3", `{"note":"not in the trip"}`)
+	assertProblem(t, res, problemNotFound)
+
+	for _, request := range [][]string{
+		{"PUT", "/trip/1", `{"name":"renamed"}`},
+		{"DELETE", "/trip/1", ""},
+		{"PUT", "/trip/1/invitations", `{"zid":"friend","role":"viewer"}`},
+		{"DELETE", "/trip/1/members/someone-else", ""},
+	} {
+		res = serveAs(s, request[0], request[1], request[2])
+		assertProblem(t, res, problemTripRole)
+	}
+
+	s.trips.UpdateTripMember(1, TripMember{User: "string3", Role: roleViewer})
+	res = serveAs(s, "PATCH", "/trip/1/markers/1", `{"note":"paris"}`)
+	assertProblem(t, res, problemTripRole)
+	res = serveAs(s, "GET", "/export/csv?trip=1", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	res = serveAs(s, "DELETE", "/trip/1/members/string3", "")
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	res = serveAs(s, "GET", "/trip/1", "")
+	assertProblem(t, res, problemNotFound)
+}
+
+func TestMemoryManageTripMembers(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	s.trips.InsertTrip(&Trip{User: "string3", Name: "France"})
+
+	res := serveAs(s, "PUT", "/trip/1/invitations", `{"zid":"friend","role":"viewer"}`)
+	assert.Equal(t, http.StatusCreated, res.Code)
+	assert.Equal(t, `{"id":1,"trip_id":1,"zid":"friend","role":"viewer","invited_by":"string3","created_at":"2019-03-10T20:33:20Z"}`, res.Body.String())
+
+	res = serveAs(s, "PUT", "/trip/1/invitations", `{"zid":"friend","role":"editor"}`)
+	assert.Equal(t, http.StatusCreated, res.Code)
+	res = serveAs(s, "GET", "/trip/1/invitations", "")
+	assert.Equal(t, `{"invitations":[{"id":1,"trip_id":1,"zid":"friend","role":"editor","invited_by":"string3","created_at":"2019-03-10T20:33:20Z"}]}`, res.Body.String())
+
+	invalidInvitations := []struct {
+		body   string
+		errors []fieldError
+	}{
+		{`{}`, []fieldError{{"zid", "is required"}, {"role", "is required"}}},
+		{`{"zid":" ","role":"admin"}`, []fieldError{{"zid", "must not be blank"}, {"role", "must be one of owner, editor and viewer"}}},
+		{`{"zid":"string3","role":"viewer"}`, []fieldError{{"zid", "is already a member of this trip"}}},
+	}
+	for _, invitation := range invalidInvitations {
+		res = serveAs(s, "PUT", "/trip/1/invitations", invitation.body)
+		assertProblem(t, res, problemValidation, invitation.errors...)
+	}
+
+	res = serveAs(s, "POST", "/invitation/1/accept", "")
+	assertProblem(t, res, problemNotFound)
+	s.trips.AcceptInvitation(1)
+
+	res = serveAs(s, "PUT", "/trip/1/members/friend", `{"role":"owner"}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	res = serveAs(s, "GET", "/trip/1/members", "")
+	assert.Equal(t, `{"members":[{"zid":"string3","role":"owner"},{"zid":"friend","role":"owner"}]}`, res.Body.String())
+
+	res = serveAs(s, "PUT", "/trip/1", `{"name":"France","visibility":"private"}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	res = serveAs(s, "PUT", "/trip/1/invitations", `{"zid":"friend","role":"viewer"}`)
+	assertProblem(t, res, problemValidation, fieldError{"zid", "is already a member of this trip"})
+
+	res = serveAs(s, "PUT", "/trip/1/members/string3", `{"role":"viewer"}`)
+	assertProblem(t, res, problemValidation, fieldError{"role", "can not be changed for the creator of the trip"})
+	res = serveAs(s, "PUT", "/trip/1/members/stranger", `{"role":"viewer"}`)
+	assertProblem(t, res, problemNotFound)
+
+	res = serveAs(s, "DELETE", "/trip/1/members/friend", "")
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	res = serveAs(s, "DELETE", "/trip/1/members/friend", "")
+	assertProblem(t, res, problemNotFound)
+
+	serveAs(s, "PUT", "/trip/1/invitations", `{"zid":"friend","role":"viewer"}`)
+	res = serveAs(s, "DELETE", "/invitation/2", "")
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	res = serveAs(s, "GET", "/trip/1/invitations", "")
+	assert.Equal(t, `{"invitations":[]}`, res.Body.String())
+}
+
+func TestTripMemberQueries(t *testing.T) {
+	s, mock := getMockServer()
+	defer s.finalize()
+
+	expectTripAccess(mock, "string3", 7, "someone-else", roleViewer)
+	mock.ExpectQuery(`FROM trips\s+WHERE id=\$1\s+UNION ALL\s+SELECT username, role, false FROM trip_members\s+WHERE trip_id=\$1\s+ORDER BY creator DESC, username`).
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "role", "creator"}).
+			AddRow("someone-else", "owner", true).
+			AddRow("string3", "viewer", false))
+
+	res := serveAs(s, "GET", "/trip/7/members", "")
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, `{"members":[{"zid":"someone-else","role":"owner"},{"zid":"string3","role":"viewer"}]}`, res.Body.String())
+
+	expectTripAccess(mock, "string3", 7, "someone-else", roleEditor)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id FROM trips`).
+		WithArgs("someone-else", 7).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectQuery(`AND \(username=\$1 OR \(visibility<>'private' AND id IN \(SELECT marker_id FROM trip_markers WHERE trip_id=\$3\)\)\)`).
+		WithArgs("string3", sqlmock.AnyArg(), 7).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectRollback()
+
+	res = serveAs(s, "PUT", "/trip/7/markers", `{"marker_ids":[1,2]}`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assertProblem(t, res, problemValidation, fieldError{"marker_ids", "must only contain your markers"})
+
+	mock.ExpectQuery(`UPDATE markers\s+SET lat=\$3, long=\$4, note=\$5, visited_at=\$6, visited_offset=\$7, changed_by=\$8, visibility=COALESCE\(NULLIF\(\$9, ''\), visibility\)`).
+		WithArgs("someone-else", 1, 1.5, 1.5, "fixed", nil, nil, "string3", "").
+		WillReturnRows(sqlmock.NewRows([]string{"visibility", "created_at", "updated_at"}).AddRow("private", stubMarkerTime, stubMarkerTime))
+
+	marker := &Marker{ID: 1, User: "someone-else", Lat: 1.5, Lng: 1.5, Note: "fixed", ChangedBy: "string3"}
+	err := s.store.Update(marker)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, err)
+	assert.Equal(t, visibilityPrivate, marker.Visibility)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO trip_members \(trip_id, username, role\)\s+SELECT trip_id, username, role FROM trip_invitations\s+WHERE id=\$1`).
+		WithArgs(3).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DELETE FROM trip_invitations WHERE id=\$1`).
+		WithArgs(3).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	assert.Equal(t, errInvitationNotFound, s.trips.AcceptInvitation(3))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
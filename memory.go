@@ -0,0 +1,887 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore is a MarkerStore, TripStore, ShareStore and ProfileStore that keeps everything in the process memory.
+// It is meant for running the service locally and for tests, nothing survives a restart.
+type memoryStore struct {
+	mu      sync.RWMutex
+	markers []Marker
+	lastID  int64
+
+	trips       []Trip
+	tripMarkers map[int64][]int64
+	lastTripID  int64
+
+	// members are the members of each trip but its creator
+	members          map[int64][]TripMember
+	invitations      []Invitation
+	lastInvitationID int64
+
+	revisions map[int64][]MarkerRevision
+
+	shares      []ShareLink
+	lastShareID int64
+
+	profiles []Profile
+
+	// now stamps the markers, tests replace it with a fixed clock
+	now func() time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{tripMarkers: map[int64][]int64{}, members: map[int64][]TripMember{}, revisions: map[int64][]MarkerRevision{}, now: time.Now}
+}
+
+func (s *memoryStore) Insert(m *Marker) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.insert(m)
+	return nil
+}
+
+func (s *memoryStore) List(user string, filter MarkerFilter) (*MarkerCollection, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	markers := s.markers
+	if filter.AsOf != nil {
+		markers = s.markersAsOf(*filter.AsOf)
+	}
+
+	var markerCollection MarkerCollection
+	for _, m := range markers {
+		if m.User == user && m.DeletedAt == nil && filter.matches(&m) {
+			markerCollection.Markers = append(markerCollection.Markers, m)
+		}
+	}
+
+	markers = markerCollection.Markers
+	sort.SliceStable(markers, func(i, j int) bool {
+		return filter.Sort.before(&markers[i], &markers[j])
+	})
+
+	filter.paginate(&markerCollection)
+	return &markerCollection, nil
+}
+
+func (s *memoryStore) Near(user string, query NearQuery) (*MarkerCollection, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var markerCollection MarkerCollection
+	for _, m := range s.markers {
+		if m.User != user || m.DeletedAt != nil {
+			continue
+		}
+
+		distance := haversine(query.Lat, query.Lng, m.Lat, m.Lng)
+		if query.Radius > 0 && distance > query.Radius {
+			continue
+		}
+
+		m.Distance = &distance
+		markerCollection.Markers = append(markerCollection.Markers, m)
+	}
+
+	markers := markerCollection.Markers
+	sort.SliceStable(markers, func(i, j int) bool {
+		return *markers[i].Distance < *markers[j].Distance
+	})
+
+	if query.Limit > 0 && len(markers) > query.Limit {
+		markerCollection.Markers = markers[:query.Limit]
+	}
+	return &markerCollection, nil
+}
+
+func (s *memoryStore) Get(user string, id int64) (*Marker, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.find(user, id)
+	if i < 0 {
+		return nil, errMarkerNotFound
+	}
+
+	marker := s.markers[i]
+	return &marker, nil
+}
+
+func (s *memoryStore) Update(m *Marker) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.update(m)
+}
+
+func (s *memoryStore) Delete(user string, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.delete(user, id)
+}
+
+func (s *memoryStore) GetAt(user string, lat float64, lng float64) (*Marker, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, m := range s.markers {
+		if m.User == user && m.DeletedAt == nil && m.Lat == lat && m.Lng == lng {
+			marker := m
+			return &marker, nil
+		}
+	}
+	return nil, errMarkerNotFound
+}
+
+func (s *memoryStore) DeleteAt(user string, lat float64, lng float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := false
+	for i, m := range s.markers {
+		if m.User == user && m.DeletedAt == nil && m.Lat == lat && m.Lng == lng {
+			s.trash(i)
+			found = true
+		}
+	}
+
+	if !found {
+		return errMarkerNotFound
+	}
+	return nil
+}
+
+func (s *memoryStore) Trash(user string) (*MarkerCollection, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var markerCollection MarkerCollection
+	for _, m := range s.markers {
+		if m.User == user && m.DeletedAt != nil {
+			markerCollection.Markers = append(markerCollection.Markers, m)
+		}
+	}
+
+	markers := markerCollection.Markers
+	sort.SliceStable(markers, func(i, j int) bool {
+		return markers[i].DeletedAt.After(*markers[j].DeletedAt)
+	})
+	return &markerCollection, nil
+}
+
+func (s *memoryStore) Restore(user string, id int64) (*Marker, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, m := range s.markers {
+		if m.ID == id && m.User == user && m.DeletedAt != nil {
+			s.markers[i].DeletedAt = nil
+			s.record(&s.markers[i], revisionRestored)
+			marker := s.markers[i]
+			return &marker, nil
+		}
+	}
+	return nil, errMarkerNotFound
+}
+
+func (s *memoryStore) Purge(deletedBefore time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged int64
+	kept := s.markers[:0]
+	for _, m := range s.markers {
+		if m.DeletedAt != nil && m.DeletedAt.Before(deletedBefore) {
+			s.detachMarker(m.ID)
+			delete(s.revisions, m.ID)
+			purged++
+		} else {
+			kept = append(kept, m)
+		}
+	}
+	s.markers = kept
+	return purged, nil
+}
+
+func (s *memoryStore) History(user string, id int64) (*MarkerHistory, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, m := range s.markers {
+		if m.ID == id && m.User == user {
+			revisions := append([]MarkerRevision(nil), s.revisions[id]...)
+			return &MarkerHistory{MarkerID: id, Revisions: revisions}, nil
+		}
+	}
+	return nil, errMarkerNotFound
+}
+
+func (s *memoryStore) Batch(operations []BatchOperation, atomic bool) ([]error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved := s.snapshot()
+	results := make([]error, len(operations))
+
+	for i, operation := range operations {
+		switch operation.Kind {
+		case batchCreate:
+			s.insert(operation.Marker)
+		case batchUpdate:
+			results[i] = s.update(operation.Marker)
+		case batchDelete:
+			results[i] = s.delete(operation.Marker.User, operation.Marker.ID)
+		}
+
+		if results[i] != nil && atomic {
+			s.restore(saved)
+			return results, nil
+		}
+	}
+	return results, nil
+}
+
+func (s *memoryStore) Ping() error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) insert(m *Marker) {
+	s.lastID++
+	m.ID = s.lastID
+	m.Visibility = visibilityOrDefault(m.Visibility)
+	m.CreatedAt = s.now().UTC()
+	m.UpdatedAt = m.CreatedAt
+	s.markers = append(s.markers, *m)
+	s.record(m, revisionCreated)
+}
+
+func (s *memoryStore) update(m *Marker) error {
+	i := s.find(m.User, m.ID)
+	if i < 0 {
+		return errMarkerNotFound
+	}
+
+	previous := s.markers[i]
+	if m.Visibility == "" {
+		m.Visibility = previous.Visibility
+	}
+	m.CreatedAt = previous.CreatedAt
+	m.UpdatedAt = s.now().UTC()
+	s.markers[i] = *m
+	s.markers[i].ChangedBy = ""
+
+	if m.Lat != previous.Lat || m.Lng != previous.Lng || m.Note != previous.Note || !sameVisit(m.VisitedAt, previous.VisitedAt) {
+		s.record(m, revisionUpdated)
+	}
+	return nil
+}
+
+func (s *memoryStore) delete(user string, id int64) error {
+	i := s.find(user, id)
+	if i < 0 {
+		return errMarkerNotFound
+	}
+
+	s.trash(i)
+	return nil
+}
+
+// trash marks the marker at index i as deleted, it stays attached to its trips until purged
+func (s *memoryStore) trash(i int) {
+	deletedAt := s.now().UTC()
+	s.markers[i].DeletedAt = &deletedAt
+	s.record(&s.markers[i], revisionDeleted)
+}
+
+// record appends the current state of m to its revisions
+func (s *memoryStore) record(m *Marker, action string) {
+	revisions := s.revisions[m.ID]
+	s.revisions[m.ID] = append(revisions, MarkerRevision{
+		Revision:  int64(len(revisions) + 1),
+		Action:    action,
+		Lat:       m.Lat,
+		Lng:       m.Lng,
+		Note:      m.Note,
+		VisitedAt: m.VisitedAt,
+		ChangedBy: m.changer(),
+		ChangedAt: s.now().UTC(),
+	})
+}
+
+// markersAsOf rebuilds every marker from its last revision made at or before at, trashed ones keep a DeletedAt
+func (s *memoryStore) markersAsOf(at time.Time) []Marker {
+	var markers []Marker
+	for _, m := range s.markers {
+		var last *MarkerRevision
+		for i, revision := range s.revisions[m.ID] {
+			if revision.ChangedAt.After(at) {
+				break
+			}
+			last = &s.revisions[m.ID][i]
+		}
+		if last == nil {
+			continue
+		}
+
+		past := Marker{ID: m.ID, User: m.User, Lat: last.Lat, Lng: last.Lng, Note: last.Note, Visibility: m.Visibility,
+			VisitedAt: last.VisitedAt, CreatedAt: m.CreatedAt, UpdatedAt: last.ChangedAt}
+		if last.Action == revisionDeleted {
+			past.DeletedAt = &last.ChangedAt
+		}
+		markers = append(markers, past)
+	}
+	return markers
+}
+
+// sameVisit tells whether two visit times are the same instant given in the same time zone
+func sameVisit(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	_, offsetA := a.Zone()
+	_, offsetB := b.Zone()
+	return a.Equal(*b) && offsetA == offsetB
+}
+
+// memorySnapshot is a copy of the store content, taken to roll a batch back
+type memorySnapshot struct {
+	markers     []Marker
+	lastID      int64
+	trips       []Trip
+	tripMarkers map[int64][]int64
+	revisions   map[int64][]MarkerRevision
+}
+
+func (s *memoryStore) snapshot() *memorySnapshot {
+	saved := &memorySnapshot{
+		markers:     append([]Marker(nil), s.markers...),
+		lastID:      s.lastID,
+		trips:       append([]Trip(nil), s.trips...),
+		tripMarkers: make(map[int64][]int64, len(s.tripMarkers)),
+		revisions:   make(map[int64][]MarkerRevision, len(s.revisions)),
+	}
+	for id, markerIDs := range s.tripMarkers {
+		saved.tripMarkers[id] = append([]int64(nil), markerIDs...)
+	}
+	for id, revisions := range s.revisions {
+		saved.revisions[id] = append([]MarkerRevision(nil), revisions...)
+	}
+	return saved
+}
+
+func (s *memoryStore) restore(saved *memorySnapshot) {
+	s.markers = saved.markers
+	s.lastID = saved.lastID
+	s.trips = saved.trips
+	s.tripMarkers = saved.tripMarkers
+	s.revisions = saved.revisions
+}
+
+// find returns the index of the marker with the given id owned by user, or -1 when it is missing or trashed
+func (s *memoryStore) find(user string, id int64) int {
+	for i, m := range s.markers {
+		if m.ID == id && m.User == user && m.DeletedAt == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// findByID returns the index of the marker with the given id whoever owns it, or -1 when it is missing or trashed
+func (s *memoryStore) findByID(id int64) int {
+	for i, m := range s.markers {
+		if m.ID == id && m.DeletedAt == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryStore) InsertTrip(t *Trip) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.insertTrip(t)
+	return nil
+}
+
+func (s *memoryStore) insertTrip(t *Trip) {
+	s.lastTripID++
+	t.ID = s.lastTripID
+	t.Visibility = visibilityOrDefault(t.Visibility)
+	s.trips = append(s.trips, *t)
+}
+
+func (s *memoryStore) ListTrips(user string) (*TripCollection, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tripCollection TripCollection
+	for _, t := range s.trips {
+		if t.User == user || (t.Visibility != visibilityPrivate && s.memberRole(t.ID, user) != "") {
+			tripCollection.Trips = append(tripCollection.Trips, s.visibleTrip(t))
+		}
+	}
+	return &tripCollection, nil
+}
+
+func (s *memoryStore) GetTrip(user string, id int64) (*Trip, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.findTrip(user, id)
+	if i < 0 {
+		return nil, errTripNotFound
+	}
+
+	trip := s.visibleTrip(s.trips[i])
+	return &trip, nil
+}
+
+func (s *memoryStore) UpdateTrip(t *Trip) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.findTrip(t.User, t.ID)
+	if i < 0 {
+		return errTripNotFound
+	}
+
+	if t.Visibility == "" {
+		t.Visibility = s.trips[i].Visibility
+	}
+	s.trips[i] = *t
+	return nil
+}
+
+func (s *memoryStore) DeleteTrip(user string, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.findTrip(user, id)
+	if i < 0 {
+		return errTripNotFound
+	}
+
+	delete(s.tripMarkers, id)
+	delete(s.members, id)
+	s.trips = append(s.trips[:i], s.trips[i+1:]...)
+
+	invitations := s.invitations[:0]
+	for _, inv := range s.invitations {
+		if inv.TripID != id {
+			invitations = append(invitations, inv)
+		}
+	}
+	s.invitations = invitations
+
+	kept := s.shares[:0]
+	for _, link := range s.shares {
+		if link.TripID == nil || *link.TripID != id {
+			kept = append(kept, link)
+		}
+	}
+	s.shares = kept
+	return nil
+}
+
+func (s *memoryStore) TripMarkers(user string, id int64) ([]Marker, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.findTrip(user, id) < 0 {
+		return nil, errTripNotFound
+	}
+
+	markers := []Marker{}
+	for _, markerID := range s.tripMarkers[id] {
+		if i := s.findByID(markerID); i >= 0 {
+			markers = append(markers, s.markers[i])
+		}
+	}
+	return markers, nil
+}
+
+func (s *memoryStore) SetTripMarkers(user string, id int64, editor string, markerIDs []int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.findTrip(user, id) < 0 {
+		return errTripNotFound
+	}
+
+	attached := map[int64]bool{}
+	var hidden []int64
+	for _, markerID := range s.tripMarkers[id] {
+		i := s.findByID(markerID)
+		if i >= 0 && s.markers[i].User != editor && s.markers[i].Visibility == visibilityPrivate {
+			hidden = append(hidden, markerID)
+			continue
+		}
+		attached[markerID] = true
+	}
+
+	for _, markerID := range markerIDs {
+		i := s.findByID(markerID)
+		if i < 0 || (s.markers[i].User != editor && !attached[markerID]) {
+			return errMarkerNotFound
+		}
+	}
+
+	s.tripMarkers[id] = append(append([]int64(nil), markerIDs...), hidden...)
+	return nil
+}
+
+func (s *memoryStore) ImportTrips(markers []Marker, trips []TripImport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range markers {
+		s.insert(&markers[i])
+	}
+
+	for i := range trips {
+		s.insertTrip(&trips[i].Trip)
+
+		markerIDs := make([]int64, len(trips[i].Markers))
+		for j, index := range trips[i].Markers {
+			markerIDs[j] = markers[index].ID
+		}
+		s.tripMarkers[trips[i].Trip.ID] = markerIDs
+	}
+	return nil
+}
+
+// findTrip returns the index of the trip with the given id owned by user, or -1
+func (s *memoryStore) findTrip(user string, id int64) int {
+	for i, t := range s.trips {
+		if t.ID == id && t.User == user {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryStore) TripAccess(user string, id int64) (*TripAccess, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, t := range s.trips {
+		if t.ID != id {
+			continue
+		}
+		if t.User == user {
+			return &TripAccess{Creator: t.User, Role: roleOwner}, nil
+		}
+		if role := s.memberRole(id, user); role != "" && t.Visibility != visibilityPrivate {
+			return &TripAccess{Creator: t.User, Role: role}, nil
+		}
+	}
+	return nil, errTripNotFound
+}
+
+func (s *memoryStore) TripMembers(id int64) (*TripMembers, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, t := range s.trips {
+		if t.ID == id {
+			members := append([]TripMember(nil), s.members[id]...)
+			sort.Slice(members, func(i, j int) bool { return members[i].User < members[j].User })
+			return &TripMembers{Members: append([]TripMember{{User: t.User, Role: roleOwner}}, members...)}, nil
+		}
+	}
+	return nil, errTripNotFound
+}
+
+func (s *memoryStore) UpdateTripMember(id int64, member TripMember) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, m := range s.members[id] {
+		if m.User == member.User {
+			s.members[id][i].Role = member.Role
+			return nil
+		}
+	}
+	return errMemberNotFound
+}
+
+func (s *memoryStore) RemoveTripMember(id int64, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	members := s.members[id]
+	for i, m := range members {
+		if m.User == user {
+			s.members[id] = append(members[:i], members[i+1:]...)
+			return nil
+		}
+	}
+	return errMemberNotFound
+}
+
+func (s *memoryStore) InsertInvitation(inv *Invitation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inv.CreatedAt = s.now().UTC()
+	for i, pending := range s.invitations {
+		if pending.TripID == inv.TripID && pending.User == inv.User {
+			inv.ID = pending.ID
+			s.invitations[i] = *inv
+			return nil
+		}
+	}
+
+	s.lastInvitationID++
+	inv.ID = s.lastInvitationID
+	s.invitations = append(s.invitations, *inv)
+	return nil
+}
+
+func (s *memoryStore) Invitations(user string) (*InvitationCollection, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	collection := InvitationCollection{Invitations: []Invitation{}}
+	for _, inv := range s.invitations {
+		if inv.User == user {
+			collection.Invitations = append(collection.Invitations, inv)
+		}
+	}
+	return &collection, nil
+}
+
+func (s *memoryStore) TripInvitations(id int64) (*InvitationCollection, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	collection := InvitationCollection{Invitations: []Invitation{}}
+	for _, inv := range s.invitations {
+		if inv.TripID == id {
+			collection.Invitations = append(collection.Invitations, inv)
+		}
+	}
+	return &collection, nil
+}
+
+func (s *memoryStore) GetInvitation(id int64) (*Invitation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if i := s.findInvitation(id); i >= 0 {
+		inv := s.invitations[i]
+		return &inv, nil
+	}
+	return nil, errInvitationNotFound
+}
+
+func (s *memoryStore) AcceptInvitation(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.findInvitation(id)
+	if i < 0 {
+		return errInvitationNotFound
+	}
+	inv := s.invitations[i]
+	s.invitations = append(s.invitations[:i], s.invitations[i+1:]...)
+
+	for j, m := range s.members[inv.TripID] {
+		if m.User == inv.User {
+			s.members[inv.TripID][j].Role = inv.Role
+			return nil
+		}
+	}
+	s.members[inv.TripID] = append(s.members[inv.TripID], TripMember{User: inv.User, Role: inv.Role})
+	return nil
+}
+
+func (s *memoryStore) DeleteInvitation(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.findInvitation(id)
+	if i < 0 {
+		return errInvitationNotFound
+	}
+	s.invitations = append(s.invitations[:i], s.invitations[i+1:]...)
+	return nil
+}
+
+// memberRole returns the role of user on a trip they did not create, empty when they are not a member
+func (s *memoryStore) memberRole(id int64, user string) string {
+	for _, m := range s.members[id] {
+		if m.User == user {
+			return m.Role
+		}
+	}
+	return ""
+}
+
+func (s *memoryStore) findInvitation(id int64) int {
+	for i, inv := range s.invitations {
+		if inv.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryStore) SetProfile(p *Profile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, profile := range s.profiles {
+		if profile.Handle == p.Handle && profile.User != p.User {
+			return errHandleTaken
+		}
+	}
+
+	if i := s.findProfile(p.User); i >= 0 {
+		s.profiles[i] = *p
+		return nil
+	}
+	s.profiles = append(s.profiles, *p)
+	return nil
+}
+
+func (s *memoryStore) GetProfile(user string) (*Profile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if i := s.findProfile(user); i >= 0 {
+		profile := s.profiles[i]
+		return &profile, nil
+	}
+	return nil, errProfileNotFound
+}
+
+func (s *memoryStore) ProfileByHandle(handle string) (*Profile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, profile := range s.profiles {
+		if profile.Handle == handle {
+			return &profile, nil
+		}
+	}
+	return nil, errProfileNotFound
+}
+
+func (s *memoryStore) PublicTrips(user string) ([]Trip, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	trips := []Trip{}
+	for _, t := range s.trips {
+		if t.User == user && t.Visibility == visibilityPublic {
+			trips = append(trips, s.visibleTrip(t))
+		}
+	}
+	return trips, nil
+}
+
+func (s *memoryStore) findProfile(user string) int {
+	for i, profile := range s.profiles {
+		if profile.User == user {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryStore) InsertShare(link *ShareLink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastShareID++
+	link.ID = s.lastShareID
+	link.CreatedAt = s.now().UTC()
+
+	saved := *link
+	saved.Token = ""
+	s.shares = append(s.shares, saved)
+	return nil
+}
+
+func (s *memoryStore) ListShares(user string) (*ShareCollection, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	collection := ShareCollection{Links: []ShareLink{}}
+	for _, link := range s.shares {
+		if link.User == user && s.activeShare(&link) {
+			collection.Links = append(collection.Links, link)
+		}
+	}
+	return &collection, nil
+}
+
+func (s *memoryStore) RevokeShare(user string, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, link := range s.shares {
+		if link.ID == id && link.User == user {
+			s.shares = append(s.shares[:i], s.shares[i+1:]...)
+			return nil
+		}
+	}
+	return errShareNotFound
+}
+
+func (s *memoryStore) ShareByToken(tokenHash string) (*ShareLink, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, link := range s.shares {
+		if link.TokenHash == tokenHash && s.activeShare(&link) {
+			return &link, nil
+		}
+	}
+	return nil, errShareNotFound
+}
+
+func (s *memoryStore) activeShare(link *ShareLink) bool {
+	return link.ExpiresAt == nil || link.ExpiresAt.After(s.now())
+}
+
+// visibleTrip hides the cover of t when its marker is in the trash
+func (s *memoryStore) visibleTrip(t Trip) Trip {
+	if t.CoverMarkerID != nil && s.find(t.User, *t.CoverMarkerID) < 0 {
+		t.CoverMarkerID = nil
+	}
+	return t
+}
+
+// detachMarker removes a marker about to be purged from every trip, and from their covers
+func (s *memoryStore) detachMarker(id int64) {
+	for tripID, markerIDs := range s.tripMarkers {
+		kept := markerIDs[:0]
+		for _, markerID := range markerIDs {
+			if markerID != id {
+				kept = append(kept, markerID)
+			}
+		}
+		s.tripMarkers[tripID] = kept
+	}
+
+	for i := range s.trips {
+		if cover := s.trips[i].CoverMarkerID; cover != nil && *cover == id {
+			s.trips[i].CoverMarkerID = nil
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// migration is one versioned change to the database schema.
+// Once a migration ran against a database its up script must never be edited,
+// add a new migration instead.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// migrations is the ordered list of schema changes, embedded in the binary
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create_markers",
+		up: `
+		CREATE TABLE IF NOT EXISTS markers
+		(
+			id SERIAL PRIMARY KEY,
+			username TEXT NOT NULL,
+			lat DOUBLE PRECISION NOT NULL,
+			long DOUBLE PRECISION NOT NULL,
+			note TEXT
+		);`,
+		down: `
+		DROP TABLE markers;`,
+	},
+	{
+		version: 2,
+		name:    "index_markers_position",
+		up: `
+		CREATE INDEX markers_username_lat_long_idx ON markers (username, lat, long);`,
+		down: `
+		DROP INDEX markers_username_lat_long_idx;`,
+	},
+	{
+		version: 3,
+		name:    "create_trips",
+		up: `
+		CREATE TABLE trips
+		(
+			id SERIAL PRIMARY KEY,
+			username TEXT NOT NULL,
+			name TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			start_date DATE,
+			end_date DATE,
+			cover_marker_id INTEGER REFERENCES markers (id) ON DELETE SET NULL
+		);
+		CREATE INDEX trips_username_idx ON trips (username);
+		CREATE TABLE trip_markers
+		(
+			trip_id INTEGER NOT NULL REFERENCES trips (id) ON DELETE CASCADE,
+			marker_id INTEGER NOT NULL REFERENCES markers (id) ON DELETE CASCADE,
+			position INTEGER NOT NULL,
+			PRIMARY KEY (trip_id, marker_id)
+		);
+		CREATE INDEX trip_markers_marker_id_idx ON trip_markers (marker_id);`,
+		down: `
+		DROP TABLE trip_markers;
+		DROP TABLE trips;`,
+	},
+	{
+		version: 4,
+		name:    "add_markers_timestamps",
+		up: `
+		ALTER TABLE markers
+			ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			ADD COLUMN visited_at TIMESTAMPTZ,
+			ADD COLUMN visited_offset INTEGER;
+		CREATE INDEX markers_username_visited_at_idx ON markers (username, visited_at);`,
+		down: `
+		DROP INDEX markers_username_visited_at_idx;
+		ALTER TABLE markers
+			DROP COLUMN created_at,
+			DROP COLUMN updated_at,
+			DROP COLUMN visited_at,
+			DROP COLUMN visited_offset;`,
+	},
+	{
+		version: 5,
+		name:    "add_markers_deleted_at",
+		up: `
+		ALTER TABLE markers ADD COLUMN deleted_at TIMESTAMPTZ;
+		CREATE INDEX markers_deleted_at_idx ON markers (deleted_at) WHERE deleted_at IS NOT NULL;`,
+		down: `
+		DELETE FROM markers WHERE deleted_at IS NOT NULL;
+		ALTER TABLE markers DROP COLUMN deleted_at;`,
+	},
+	{
+		version: 6,
+		name:    "create_marker_revisions",
+		up: `
+		CREATE TABLE marker_revisions
+		(
+			marker_id INTEGER NOT NULL REFERENCES markers (id) ON DELETE CASCADE,
+			revision INTEGER NOT NULL,
+			action TEXT NOT NULL,
+			lat DOUBLE PRECISION NOT NULL,
+			long DOUBLE PRECISION NOT NULL,
+			note TEXT,
+			visited_at TIMESTAMPTZ,
+			visited_offset INTEGER,
+			changed_by TEXT NOT NULL,
+			changed_at TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (marker_id, revision)
+		);
+		CREATE INDEX marker_revisions_changed_at_idx ON marker_revisions (changed_at);
+		INSERT INTO marker_revisions (marker_id, revision, action, lat, long, note, visited_at, visited_offset, changed_by, changed_at)
+		SELECT id, 1, 'created', lat, long, note, visited_at, visited_offset, username, created_at FROM markers;
+		CREATE FUNCTION record_marker_revision() RETURNS trigger AS $$
+		DECLARE
+			change TEXT := 'updated';
+		BEGIN
+			IF TG_OP = 'INSERT' THEN
+				change := 'created';
+			ELSIF (NEW.lat, NEW.long, NEW.note, NEW.visited_at, NEW.visited_offset, NEW.deleted_at) IS NOT DISTINCT FROM
+				(OLD.lat, OLD.long, OLD.note, OLD.visited_at, OLD.visited_offset, OLD.deleted_at) THEN
+				RETURN NULL;
+			ELSIF NEW.deleted_at IS NOT NULL AND OLD.deleted_at IS NULL THEN
+				change := 'deleted';
+			ELSIF NEW.deleted_at IS NULL AND OLD.deleted_at IS NOT NULL THEN
+				change := 'restored';
+			END IF;
+
+			INSERT INTO marker_revisions (marker_id, revision, action, lat, long, note, visited_at, visited_offset, changed_by, changed_at)
+			SELECT NEW.id, COALESCE(max(revision), 0) + 1, change,
+				NEW.lat, NEW.long, NEW.note, NEW.visited_at, NEW.visited_offset, NEW.username, now()
+			FROM marker_revisions WHERE marker_id = NEW.id;
+			RETURN NULL;
+		END
+		$$ LANGUAGE plpgsql;
+		CREATE TRIGGER markers_record_revision AFTER INSERT OR UPDATE ON markers
+			FOR EACH ROW EXECUTE PROCEDURE record_marker_revision();`,
+		down: `
+		DROP TRIGGER markers_record_revision ON markers;
+		DROP FUNCTION record_marker_revision();
+		DROP TABLE marker_revisions;`,
+	},
+	{
+		version: 7,
+		name:    "create_share_links",
+		up: `
+		CREATE TABLE share_links
+		(
+			id SERIAL PRIMARY KEY,
+			username TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			trip_id INTEGER REFERENCES trips (id) ON DELETE CASCADE,
+			filter TEXT NOT NULL DEFAULT '',
+			password_hash TEXT,
+			expires_at TIMESTAMPTZ,
+			revoked_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX share_links_username_idx ON share_links (username);`,
+		down: `
+		DROP TABLE share_links;`,
+	},
+	{
+		version: 8,
+		name:    "create_trip_members",
+		up: `
+		CREATE TABLE trip_members
+		(
+			trip_id INTEGER NOT NULL REFERENCES trips (id) ON DELETE CASCADE,
+			username TEXT NOT NULL,
+			role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+			PRIMARY KEY (trip_id, username)
+		);
+		CREATE INDEX trip_members_username_idx ON trip_members (username);
+		CREATE TABLE trip_invitations
+		(
+			id SERIAL PRIMARY KEY,
+			trip_id INTEGER NOT NULL REFERENCES trips (id) ON DELETE CASCADE,
+			username TEXT NOT NULL,
+			role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+			invited_by TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			UNIQUE (trip_id, username)
+		);
+		CREATE INDEX trip_invitations_username_idx ON trip_invitations (username);
+		ALTER TABLE markers ADD COLUMN changed_by TEXT;
+		CREATE OR REPLACE FUNCTION record_marker_revision() RETURNS trigger AS $$
+		DECLARE
+			change TEXT := 'updated';
+		BEGIN
+			IF TG_OP = 'INSERT' THEN
+				change := 'created';
+			ELSIF (NEW.lat, NEW.long, NEW.note, NEW.visited_at, NEW.visited_offset, NEW.deleted_at) IS NOT DISTINCT FROM
+				(OLD.lat, OLD.long, OLD.note, OLD.visited_at, OLD.visited_offset, OLD.deleted_at) THEN
+				RETURN NULL;
+			ELSIF NEW.deleted_at IS NOT NULL AND OLD.deleted_at IS NULL THEN
+				change := 'deleted';
+			ELSIF NEW.deleted_at IS NULL AND OLD.deleted_at IS NOT NULL THEN
+				change := 'restored';
+			END IF;
+
+			INSERT INTO marker_revisions (marker_id, revision, action, lat, long, note, visited_at, visited_offset, changed_by, changed_at)
+			SELECT NEW.id, COALESCE(max(revision), 0) + 1, change,
+				NEW.lat, NEW.long, NEW.note, NEW.visited_at, NEW.visited_offset, COALESCE(NEW.changed_by, NEW.username), now()
+			FROM marker_revisions WHERE marker_id = NEW.id;
+			RETURN NULL;
+		END
+		$$ LANGUAGE plpgsql;`,
+		down: `
+		CREATE OR REPLACE FUNCTION record_marker_revision() RETURNS trigger AS $$
+		DECLARE
+			change TEXT := 'updated';
+		BEGIN
+			IF TG_OP = 'INSERT' THEN
+				change := 'created';
+			ELSIF (NEW.lat, NEW.long, NEW.note, NEW.visited_at, NEW.visited_offset, NEW.deleted_at) IS NOT DISTINCT FROM
+				(OLD.lat, OLD.long, OLD.note, OLD.visited_at, OLD.visited_offset, OLD.deleted_at) THEN
+				RETURN NULL;
+			ELSIF NEW.deleted_at IS NOT NULL AND OLD.deleted_at IS NULL THEN
+				change := 'deleted';
+			ELSIF NEW.deleted_at IS NULL AND OLD.deleted_at IS NOT NULL THEN
+				change := 'restored';
+			END IF;
+
+			INSERT INTO marker_revisions (marker_id, revision, action, lat, long, note, visited_at, visited_offset, changed_by, changed_at)
+			SELECT NEW.id, COALESCE(max(revision), 0) + 1, change,
+				NEW.lat, NEW.long, NEW.note, NEW.visited_at, NEW.visited_offset, NEW.username, now()
+			FROM marker_revisions WHERE marker_id = NEW.id;
+			RETURN NULL;
+		END
+		$$ LANGUAGE plpgsql;
+		ALTER TABLE markers DROP COLUMN changed_by;
+		DROP TABLE trip_invitations;
+		DROP TABLE trip_members;`,
+	},
+	{
+		version: 9,
+		name:    "create_users_and_visibility",
+		up: `
+		CREATE TABLE users
+		(
+			username TEXT PRIMARY KEY,
+			handle TEXT NOT NULL UNIQUE,
+			display_name TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		ALTER TABLE markers ADD COLUMN visibility TEXT NOT NULL DEFAULT 'members'
+			CHECK (visibility IN ('private', 'members', 'public'));
+		ALTER TABLE trips ADD COLUMN visibility TEXT NOT NULL DEFAULT 'members'
+			CHECK (visibility IN ('private', 'members', 'public'));
+		CREATE INDEX markers_public_idx ON markers (username) WHERE visibility = 'public' AND deleted_at IS NULL;`,
+		down: `
+		DROP INDEX markers_public_idx;
+		ALTER TABLE trips DROP COLUMN visibility;
+		ALTER TABLE markers DROP COLUMN visibility;
+		DROP TABLE users;`,
+	},
+}
+
+// migrationLockID is the postgres advisory lock key taken while migrating,
+// so instances starting together do not apply the same migration twice
+const migrationLockID = 7263554
+
+func (m migration) checksum() string {
+	sum := sha256.Sum256([]byte(m.up))
+	return hex.EncodeToString(sum[:])
+}
+
+// appliedMigration is a row of the schema_migrations table
+type appliedMigration struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	Checksum  string    `json:"checksum"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+type migrator struct {
+	db         *sql.DB
+	migrations []migration
+}
+
+func newMigrator(db *sql.DB) *migrator {
+	return &migrator{db: db, migrations: migrations}
+}
+
+// up applies every pending migration in a single transaction and returns how many ran
+func (m *migrator) up() (int, error) {
+	tx, err := m.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	applied, err := m.verify(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.version]; ok {
+			continue
+		}
+
+		if _, err = tx.Exec(mig.up); err != nil {
+			return 0, fmt.Errorf("migration %d %s failed: %v", mig.version, mig.name, err)
+		}
+
+		_, err = tx.Exec(`
+		INSERT INTO schema_migrations (version, name, checksum)
+		VALUES ($1, $2, $3)
+		`, mig.version, mig.name, mig.checksum())
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	return count, tx.Commit()
+}
+
+// down reverts the last steps applied migrations, newest first
+func (m *migrator) down(steps int) (int, error) {
+	tx, err := m.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	applied, err := m.verify(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(m.migrations) - 1; i >= 0 && count < steps; i-- {
+		mig := m.migrations[i]
+		if _, ok := applied[mig.version]; !ok {
+			continue
+		}
+
+		if _, err = tx.Exec(mig.down); err != nil {
+			return 0, fmt.Errorf("reverting migration %d %s failed: %v", mig.version, mig.name, err)
+		}
+
+		if _, err = tx.Exec(`DELETE FROM schema_migrations WHERE version=$1`, mig.version); err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	return count, tx.Commit()
+}
+
+// status lists the migrations already applied to the database
+func (m *migrator) status() ([]appliedMigration, error) {
+	tx, err := m.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	applied, err := m.listApplied(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []appliedMigration
+	for _, mig := range m.migrations {
+		if a, ok := applied[mig.version]; ok {
+			result = append(result, a)
+		}
+	}
+	return result, tx.Commit()
+}
+
+func (m *migrator) begin() (*sql.Tx, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations
+	(
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);`)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// verify makes sure every applied migration is still known and unchanged
+func (m *migrator) verify(tx *sql.Tx) (map[int]appliedMigration, error) {
+	applied, err := m.listApplied(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[int]migration)
+	for _, mig := range m.migrations {
+		known[mig.version] = mig
+	}
+
+	for version, a := range applied {
+		mig, ok := known[version]
+		if !ok {
+			return nil, fmt.Errorf("database has migration %d %s which this binary does not know", version, a.Name)
+		}
+		if mig.checksum() != a.Checksum {
+			return nil, fmt.Errorf("migration %d %s was edited after being applied", version, mig.name)
+		}
+	}
+
+	return applied, nil
+}
+
+func (m *migrator) listApplied(tx *sql.Tx) (map[int]appliedMigration, error) {
+	rows, err := tx.Query(`SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var a appliedMigration
+		if err = rows.Scan(&a.Version, &a.Name, &a.Checksum, &a.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied[a.Version] = a
+	}
+
+	return applied, rows.Err()
+}
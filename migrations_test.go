@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var testMigrations = []migration{
+	{version: 1, name: "first", up: "CREATE TABLE first ();", down: "DROP TABLE first;"},
+	{version: 2, name: "second", up: "CREATE TABLE second ();", down: "DROP TABLE second;"},
+}
+
+func getMockMigrator() (*migrator, sqlmock.Sqlmock) {
+	db, mock, _ := sqlmock.New()
+	return &migrator{db: db, migrations: testMigrations}, mock
+}
+
+func expectMigrationLock(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectExec("pg_advisory_xact_lock").WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestMigrateUpAppliesPendingMigrations(t *testing.T) {
+	m, mock := getMockMigrator()
+
+	expectMigrationLock(mock)
+	mock.ExpectQuery("SELECT version, name, checksum, applied_at FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"}).
+			AddRow(1, "first", testMigrations[0].checksum(), time.Now()))
+	mock.ExpectExec("CREATE TABLE second").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").
+		WithArgs(2, "second", testMigrations[1].checksum()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	applied, err := m.up()
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrateUpRejectsEditedMigration(t *testing.T) {
+	m, mock := getMockMigrator()
+
+	expectMigrationLock(mock)
+	mock.ExpectQuery("SELECT version, name, checksum, applied_at FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"}).
+			AddRow(1, "first", "not the checksum", time.Now()))
+	mock.ExpectRollback()
+
+	applied, err := m.up()
+
+	assert.EqualError(t, err, "migration 1 first was edited after being applied")
+	assert.Equal(t, 0, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrateUpRejectsUnknownMigration(t *testing.T) {
+	m, mock := getMockMigrator()
+
+	expectMigrationLock(mock)
+	mock.ExpectQuery("SELECT version, name, checksum, applied_at FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"}).
+			AddRow(3, "from_the_future", "abc", time.Now()))
+	mock.ExpectRollback()
+
+	_, err := m.up()
+
+	assert.EqualError(t, err, "database has migration 3 from_the_future which this binary does not know")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrateDownRevertsNewestFirst(t *testing.T) {
+	m, mock := getMockMigrator()
+
+	expectMigrationLock(mock)
+	mock.ExpectQuery("SELECT version, name, checksum, applied_at FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"}).
+			AddRow(1, "first", testMigrations[0].checksum(), time.Now()).
+			AddRow(2, "second", testMigrations[1].checksum(), time.Now()))
+	mock.ExpectExec("DROP TABLE second").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM schema_migrations").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	reverted, err := m.down(1)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, reverted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrationVersionsAreOrdered(t *testing.T) {
+	for i, mig := range migrations {
+		assert.Equal(t, i+1, mig.version, mig.name)
+		assert.NotEmpty(t, mig.down, mig.name)
+	}
+}
@@ -0,0 +1,1230 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// postgresStore is the MarkerStore and TripStore backed by a postgresql database
+type postgresStore struct {
+	db *sql.DB
+}
+
+func newPostgresStore(db *sql.DB) *postgresStore {
+	return &postgresStore{db: db}
+}
+
+// sqlExecutor runs statements on the database or inside a transaction
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (p *postgresStore) Insert(m *Marker) error {
+	return insertMarker(p.db, m)
+}
+
+func insertMarker(db sqlExecutor, m *Marker) error {
+	sqlStatement := `
+	INSERT INTO markers (username, lat, long, note, visited_at, visited_offset, visibility)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING id, created_at, updated_at
+	`
+	m.Visibility = visibilityOrDefault(m.Visibility)
+	visitedAt, visitedOffset := visitColumns(m)
+	err := db.QueryRow(sqlStatement, m.User, m.Lat, m.Lng, m.Note, visitedAt, visitedOffset, m.Visibility).
+		Scan(&m.ID, &m.CreatedAt, &m.UpdatedAt)
+	m.CreatedAt, m.UpdatedAt = m.CreatedAt.UTC(), m.UpdatedAt.UTC()
+	return err
+}
+
+func (p *postgresStore) List(user string, filter MarkerFilter) (*MarkerCollection, error) {
+
+	conditions := sqlConditions{}
+
+	source := "markers"
+	if filter.AsOf != nil {
+		source = `(
+		SELECT DISTINCT ON (r.marker_id) r.marker_id AS id, m.username, r.lat, r.long, r.note, m.visibility,
+			m.created_at, r.changed_at AS updated_at, r.visited_at, r.visited_offset,
+			CASE WHEN r.action = 'deleted' THEN r.changed_at END AS deleted_at
+		FROM marker_revisions r
+		JOIN markers m ON m.id = r.marker_id
+		WHERE r.changed_at <= $` + conditions.arg(*filter.AsOf) + `
+		ORDER BY r.marker_id, r.revision DESC
+	) AS markers`
+	}
+
+	conditions.add("username=?", user)
+	conditions.add("deleted_at IS NULL")
+
+	if box := filter.Box; box != nil {
+		conditions.add("lat BETWEEN ? AND ?", box.MinLat, box.MaxLat)
+		if box.crossesAntimeridian() {
+			conditions.add("(long >= ? OR long <= ?)", box.MinLng, box.MaxLng)
+		} else {
+			conditions.add("long BETWEEN ? AND ?", box.MinLng, box.MaxLng)
+		}
+	}
+
+	if filter.VisitedAfter != nil {
+		conditions.add("visited_at >= ?", *filter.VisitedAfter)
+	}
+	if filter.VisitedBefore != nil {
+		conditions.add("visited_at < ?", *filter.VisitedBefore)
+	}
+	if filter.Visibility != "" {
+		conditions.add("visibility=?", filter.Visibility)
+	}
+	if filter.HidePrivate {
+		conditions.add("visibility<>'private'")
+	}
+
+	sortKey, direction, comparison := sortColumns(filter.Sort)
+
+	orderBy := "id" + direction
+	if !filter.Sort.byID() {
+		orderBy = sortKey + direction + ", " + orderBy
+	}
+
+	if filter.After != nil {
+		if filter.Sort.byID() {
+			conditions.add("id "+comparison+" ?", filter.After.ID)
+		} else {
+			conditions.add("("+sortKey+", id) "+comparison+" (?, ?)", *filter.After.Key, filter.After.ID)
+		}
+	}
+
+	sqlStatement := `
+	SELECT ` + markerColumns + ` FROM ` + source + `
+	WHERE ` + conditions.where() + `
+	ORDER BY ` + orderBy
+
+	if filter.Limit > 0 {
+		sqlStatement += `
+	LIMIT $` + conditions.arg(filter.Limit+1)
+	}
+
+	stmt, err := p.db.Prepare(sqlStatement)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(conditions.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var markerCollection MarkerCollection
+
+	for rows.Next() {
+		marker, err := scanMarker(rows)
+		if err != nil {
+			return nil, err
+		}
+		markerCollection.Markers = append(markerCollection.Markers, *marker)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	filter.paginate(&markerCollection)
+	return &markerCollection, nil
+}
+
+func (p *postgresStore) Near(user string, query NearQuery) (*MarkerCollection, error) {
+
+	conditions := sqlConditions{}
+	conditions.add("username=?", user)
+	conditions.add("deleted_at IS NULL")
+
+	if query.Radius > 0 {
+		span := latitudeSpan(query.Radius)
+		conditions.add("lat BETWEEN ? AND ?", query.Lat-span, query.Lat+span)
+	}
+
+	latArg := conditions.arg(query.Lat)
+	lngArg := conditions.arg(query.Lng)
+
+	sqlStatement := `
+	SELECT ` + markerColumns + `, distance FROM (
+		SELECT ` + markerColumns + `,
+		2 * ` + strconv.FormatFloat(earthRadius, 'f', -1, 64) + ` * asin(least(1, sqrt(
+			power(sin(radians(lat - $` + latArg + `) / 2), 2) +
+			cos(radians($` + latArg + `)) * cos(radians(lat)) *
+			power(sin(radians(long - $` + lngArg + `) / 2), 2)
+		))) AS distance
+		FROM markers
+		WHERE ` + conditions.where() + `
+	) AS nearby`
+
+	if query.Radius > 0 {
+		sqlStatement += `
+	WHERE distance <= $` + conditions.arg(query.Radius)
+	}
+
+	sqlStatement += `
+	ORDER BY distance, id`
+
+	if query.Limit > 0 {
+		sqlStatement += `
+	LIMIT $` + conditions.arg(query.Limit)
+	}
+
+	stmt, err := p.db.Prepare(sqlStatement)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(conditions.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var markerCollection MarkerCollection
+
+	for rows.Next() {
+		var distance float64
+		marker, err := scanMarker(rows, &distance)
+		if err != nil {
+			return nil, err
+		}
+		marker.Distance = &distance
+		markerCollection.Markers = append(markerCollection.Markers, *marker)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return &markerCollection, nil
+}
+
+func (p *postgresStore) Get(user string, id int64) (*Marker, error) {
+
+	sqlStatement := `
+	SELECT ` + markerColumns + ` FROM markers 
+	WHERE username=$1
+	AND id=$2
+	AND deleted_at IS NULL
+	`
+
+	return p.queryMarker(sqlStatement, user, id)
+}
+
+func (p *postgresStore) Update(m *Marker) error {
+	return updateMarker(p.db, m)
+}
+
+func updateMarker(db sqlExecutor, m *Marker) error {
+
+	sqlStatement := `
+	UPDATE markers
+	SET lat=$3, long=$4, note=$5, visited_at=$6, visited_offset=$7, changed_by=$8, visibility=COALESCE(NULLIF($9, ''), visibility), updated_at=now()
+	WHERE username=$1
+	AND id=$2
+	AND deleted_at IS NULL
+	RETURNING visibility, created_at, updated_at
+	`
+	visitedAt, visitedOffset := visitColumns(m)
+	err := db.QueryRow(sqlStatement, m.User, m.ID, m.Lat, m.Lng, m.Note, visitedAt, visitedOffset, m.changer(), m.Visibility).
+		Scan(&m.Visibility, &m.CreatedAt, &m.UpdatedAt)
+
+	if err == sql.ErrNoRows {
+		return errMarkerNotFound
+	}
+	m.CreatedAt, m.UpdatedAt = m.CreatedAt.UTC(), m.UpdatedAt.UTC()
+	return err
+}
+
+func (p *postgresStore) Delete(user string, id int64) error {
+	return deleteMarker(p.db, user, id)
+}
+
+func deleteMarker(db sqlExecutor, user string, id int64) error {
+
+	sqlStatement := `
+	UPDATE markers
+	SET deleted_at=now(), changed_by=username
+	WHERE username=$1
+	AND id=$2
+	AND deleted_at IS NULL
+	`
+	result, err := db.Exec(sqlStatement, user, id)
+
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result, errMarkerNotFound)
+}
+
+func (p *postgresStore) GetAt(user string, lat float64, lng float64) (*Marker, error) {
+
+	sqlStatement := `
+	SELECT ` + markerColumns + ` FROM markers 
+	WHERE username=$1
+	AND lat=$2
+	AND long=$3
+	AND deleted_at IS NULL
+	`
+
+	return p.queryMarker(sqlStatement, user, lat, lng)
+}
+
+func (p *postgresStore) DeleteAt(user string, lat float64, lng float64) error {
+
+	sqlStatement := `
+	UPDATE markers
+	SET deleted_at=now(), changed_by=username
+	WHERE username=$1
+	AND lat=$2
+	AND long=$3
+	AND deleted_at IS NULL
+	`
+	result, err := p.db.Exec(sqlStatement, user, lat, lng)
+
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result, errMarkerNotFound)
+}
+
+func (p *postgresStore) Trash(user string) (*MarkerCollection, error) {
+
+	sqlStatement := `
+	SELECT ` + markerColumns + `, deleted_at FROM markers
+	WHERE username=$1
+	AND deleted_at IS NOT NULL
+	ORDER BY deleted_at DESC, id`
+
+	rows, err := p.db.Query(sqlStatement, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var markerCollection MarkerCollection
+
+	for rows.Next() {
+		var deletedAt time.Time
+		marker, err := scanMarker(rows, &deletedAt)
+		if err != nil {
+			return nil, err
+		}
+		deletedAt = deletedAt.UTC()
+		marker.DeletedAt = &deletedAt
+		markerCollection.Markers = append(markerCollection.Markers, *marker)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return &markerCollection, nil
+}
+
+func (p *postgresStore) Restore(user string, id int64) (*Marker, error) {
+
+	sqlStatement := `
+	UPDATE markers
+	SET deleted_at=NULL, changed_by=username
+	WHERE username=$1
+	AND id=$2
+	AND deleted_at IS NOT NULL
+	RETURNING ` + markerColumns
+
+	marker, err := scanMarker(p.db.QueryRow(sqlStatement, user, id))
+	if err == sql.ErrNoRows {
+		return nil, errMarkerNotFound
+	}
+	return marker, err
+}
+
+func (p *postgresStore) Purge(deletedBefore time.Time) (int64, error) {
+
+	sqlStatement := `
+	DELETE FROM markers
+	WHERE deleted_at < $1
+	`
+	result, err := p.db.Exec(sqlStatement, deletedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (p *postgresStore) History(user string, id int64) (*MarkerHistory, error) {
+
+	sqlStatement := `
+	SELECT r.revision, r.action, r.lat, r.long, r.note, r.visited_at, r.visited_offset, r.changed_by, r.changed_at
+	FROM marker_revisions r
+	JOIN markers m ON m.id = r.marker_id
+	WHERE m.username=$1
+	AND r.marker_id=$2
+	ORDER BY r.revision`
+
+	rows, err := p.db.Query(sqlStatement, user, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := &MarkerHistory{MarkerID: id}
+
+	for rows.Next() {
+		var revision MarkerRevision
+		var note sql.NullString
+		var visitedAt pq.NullTime
+		var visitedOffset sql.NullInt64
+
+		err = rows.Scan(&revision.Revision, &revision.Action, &revision.Lat, &revision.Lng, &note,
+			&visitedAt, &visitedOffset, &revision.ChangedBy, &revision.ChangedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		revision.Note = note.String
+		revision.VisitedAt = visitTime(visitedAt, visitedOffset)
+		revision.ChangedAt = revision.ChangedAt.UTC()
+		history.Revisions = append(history.Revisions, revision)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(history.Revisions) == 0 {
+		return nil, errMarkerNotFound
+	}
+	return history, nil
+}
+
+func (p *postgresStore) Batch(operations []BatchOperation, atomic bool) ([]error, error) {
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := make([]error, len(operations))
+
+	for i, operation := range operations {
+		// a failed statement aborts the whole transaction, best effort batches roll back to before the operation instead
+		savepoint := "op_" + strconv.Itoa(i)
+		if !atomic {
+			if _, err = tx.Exec("SAVEPOINT " + savepoint); err != nil {
+				return nil, err
+			}
+		}
+
+		switch operation.Kind {
+		case batchCreate:
+			err = insertMarker(tx, operation.Marker)
+		case batchUpdate:
+			err = updateMarker(tx, operation.Marker)
+		case batchDelete:
+			err = deleteMarker(tx, operation.Marker.User, operation.Marker.ID)
+		}
+
+		if err == errMarkerNotFound {
+			results[i] = err
+			if atomic {
+				return results, nil
+			}
+			continue
+		}
+		if err != nil && !atomic {
+			if _, rollbackErr := tx.Exec("ROLLBACK TO SAVEPOINT " + savepoint); rollbackErr != nil {
+				return nil, rollbackErr
+			}
+			results[i] = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, tx.Commit()
+}
+
+func (p *postgresStore) Ping() error {
+	return p.db.Ping()
+}
+
+func (p *postgresStore) Close() error {
+	return p.db.Close()
+}
+
+func (p *postgresStore) queryMarker(sqlStatement string, args ...interface{}) (*Marker, error) {
+
+	stmt, err := p.db.Prepare(sqlStatement)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	marker, err := scanMarker(stmt.QueryRow(args...))
+
+	if err == sql.ErrNoRows {
+		return nil, errMarkerNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return marker, nil
+}
+
+// expectAffected returns notFound when a statement changed no row
+func expectAffected(result sql.Result, notFound error) error {
+	rowsAffected, _ := result.RowsAffected()
+
+	if rowsAffected == 0 {
+		return notFound
+	}
+	return nil
+}
+
+func (p *postgresStore) InsertTrip(t *Trip) error {
+	return insertTrip(p.db, t)
+}
+
+func insertTrip(db sqlExecutor, t *Trip) error {
+	sqlStatement := `
+	INSERT INTO trips (username, name, description, start_date, end_date, cover_marker_id, visibility)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING id
+	`
+	t.Visibility = visibilityOrDefault(t.Visibility)
+	return db.QueryRow(sqlStatement, t.User, t.Name, t.Description,
+		nullDate(t.StartDate), nullDate(t.EndDate), t.CoverMarkerID, t.Visibility).Scan(&t.ID)
+}
+
+// tripColumns are the columns scanned by scanTrip, dates come back in the format clients send them
+// and a cover in the trash reads as no cover
+const tripColumns = `id, username, name, description, visibility,
+	COALESCE(to_char(start_date, 'YYYY-MM-DD'), ''), COALESCE(to_char(end_date, 'YYYY-MM-DD'), ''),
+	(SELECT markers.id FROM markers WHERE markers.id = trips.cover_marker_id AND markers.deleted_at IS NULL)`
+
+func (p *postgresStore) ListTrips(user string) (*TripCollection, error) {
+
+	sqlStatement := `
+	SELECT ` + tripColumns + ` FROM trips
+	WHERE username=$1
+	OR (visibility <> 'private' AND id IN (SELECT trip_id FROM trip_members WHERE username=$1))
+	ORDER BY id`
+
+	rows, err := p.db.Query(sqlStatement, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tripCollection TripCollection
+
+	for rows.Next() {
+		trip, err := scanTrip(rows)
+		if err != nil {
+			return nil, err
+		}
+		tripCollection.Trips = append(tripCollection.Trips, *trip)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return &tripCollection, nil
+}
+
+func (p *postgresStore) GetTrip(user string, id int64) (*Trip, error) {
+
+	sqlStatement := `
+	SELECT ` + tripColumns + ` FROM trips
+	WHERE username=$1
+	AND id=$2
+	`
+
+	trip, err := scanTrip(p.db.QueryRow(sqlStatement, user, id))
+	if err == sql.ErrNoRows {
+		return nil, errTripNotFound
+	}
+	return trip, err
+}
+
+func (p *postgresStore) UpdateTrip(t *Trip) error {
+
+	sqlStatement := `
+	UPDATE trips
+	SET name=$3, description=$4, start_date=$5, end_date=$6, cover_marker_id=$7, visibility=COALESCE(NULLIF($8, ''), visibility)
+	WHERE username=$1
+	AND id=$2
+	RETURNING visibility
+	`
+	err := p.db.QueryRow(sqlStatement, t.User, t.ID, t.Name, t.Description,
+		nullDate(t.StartDate), nullDate(t.EndDate), t.CoverMarkerID, t.Visibility).Scan(&t.Visibility)
+
+	if err == sql.ErrNoRows {
+		return errTripNotFound
+	}
+	return err
+}
+
+func (p *postgresStore) DeleteTrip(user string, id int64) error {
+
+	sqlStatement := `
+	DELETE FROM trips
+	WHERE username=$1
+	AND id=$2
+	`
+	result, err := p.db.Exec(sqlStatement, user, id)
+
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result, errTripNotFound)
+}
+
+func (p *postgresStore) TripMarkers(user string, id int64) ([]Marker, error) {
+
+	if _, err := p.GetTrip(user, id); err != nil {
+		return nil, err
+	}
+
+	sqlStatement := `
+	SELECT ` + markerColumns + ` FROM trip_markers
+	JOIN markers ON markers.id = trip_markers.marker_id
+	WHERE trip_markers.trip_id=$1
+	AND markers.deleted_at IS NULL
+	ORDER BY trip_markers.position`
+
+	rows, err := p.db.Query(sqlStatement, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	markers := []Marker{}
+
+	for rows.Next() {
+		marker, err := scanMarker(rows)
+		if err != nil {
+			return nil, err
+		}
+		markers = append(markers, *marker)
+	}
+
+	return markers, rows.Err()
+}
+
+func (p *postgresStore) SetTripMarkers(user string, id int64, editor string, markerIDs []int64) error {
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var tripID int64
+	err = tx.QueryRow(`
+	SELECT id FROM trips
+	WHERE username=$1
+	AND id=$2
+	FOR UPDATE`, user, id).Scan(&tripID)
+
+	if err == sql.ErrNoRows {
+		return errTripNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var allowed int
+	err = tx.QueryRow(`
+	SELECT count(*) FROM markers
+	WHERE id = ANY($2)
+	AND deleted_at IS NULL
+	AND (username=$1 OR (visibility<>'private' AND id IN (SELECT marker_id FROM trip_markers WHERE trip_id=$3)))`,
+		editor, pq.Array(markerIDs), id).Scan(&allowed)
+
+	if err != nil {
+		return err
+	}
+	if allowed != len(markerIDs) {
+		return errMarkerNotFound
+	}
+
+	_, err = tx.Exec(`
+	DELETE FROM trip_markers
+	WHERE trip_id=$1
+	AND marker_id NOT IN (SELECT id FROM markers WHERE username<>$2 AND visibility='private')`, id, editor)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(`UPDATE trip_markers SET position=position+$2 WHERE trip_id=$1`, id, len(markerIDs)); err != nil {
+		return err
+	}
+
+	if err = attachTripMarkers(tx, id, markerIDs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// attachTripMarkers attaches markers to a trip in the given order
+func attachTripMarkers(db sqlExecutor, id int64, markerIDs []int64) error {
+	_, err := db.Exec(`
+	INSERT INTO trip_markers (trip_id, marker_id, position)
+	SELECT $1, marker_id, position FROM unnest($2::integer[]) WITH ORDINALITY AS ordered (marker_id, position)`,
+		id, pq.Array(markerIDs))
+
+	return err
+}
+
+func (p *postgresStore) ImportTrips(markers []Marker, trips []TripImport) error {
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := range markers {
+		if err = insertMarker(tx, &markers[i]); err != nil {
+			return err
+		}
+	}
+
+	for i := range trips {
+		if err = insertTrip(tx, &trips[i].Trip); err != nil {
+			return err
+		}
+
+		markerIDs := make([]int64, len(trips[i].Markers))
+		for j, index := range trips[i].Markers {
+			markerIDs[j] = markers[index].ID
+		}
+		if err = attachTripMarkers(tx, trips[i].Trip.ID, markerIDs); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (p *postgresStore) TripAccess(user string, id int64) (*TripAccess, error) {
+
+	sqlStatement := `
+	SELECT trips.username, CASE WHEN trips.username=$1 THEN 'owner' ELSE trip_members.role END FROM trips
+	LEFT JOIN trip_members ON trip_members.trip_id = trips.id AND trip_members.username=$1
+	WHERE trips.id=$2
+	AND (trips.username=$1 OR (trip_members.username IS NOT NULL AND trips.visibility <> 'private'))
+	`
+
+	var access TripAccess
+	err := p.db.QueryRow(sqlStatement, user, id).Scan(&access.Creator, &access.Role)
+	if err == sql.ErrNoRows {
+		return nil, errTripNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &access, nil
+}
+
+func (p *postgresStore) TripMembers(id int64) (*TripMembers, error) {
+
+	sqlStatement := `
+	SELECT username, 'owner' AS role, true AS creator FROM trips
+	WHERE id=$1
+	UNION ALL
+	SELECT username, role, false FROM trip_members
+	WHERE trip_id=$1
+	ORDER BY creator DESC, username`
+
+	rows, err := p.db.Query(sqlStatement, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members TripMembers
+
+	for rows.Next() {
+		var member TripMember
+		var creator bool
+		if err = rows.Scan(&member.User, &member.Role, &creator); err != nil {
+			return nil, err
+		}
+		members.Members = append(members.Members, member)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(members.Members) == 0 {
+		return nil, errTripNotFound
+	}
+	return &members, nil
+}
+
+func (p *postgresStore) UpdateTripMember(id int64, member TripMember) error {
+
+	sqlStatement := `
+	UPDATE trip_members
+	SET role=$3
+	WHERE trip_id=$1
+	AND username=$2
+	`
+	result, err := p.db.Exec(sqlStatement, id, member.User, member.Role)
+
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result, errMemberNotFound)
+}
+
+func (p *postgresStore) RemoveTripMember(id int64, user string) error {
+
+	sqlStatement := `
+	DELETE FROM trip_members
+	WHERE trip_id=$1
+	AND username=$2
+	`
+	result, err := p.db.Exec(sqlStatement, id, user)
+
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result, errMemberNotFound)
+}
+
+func (p *postgresStore) InsertInvitation(inv *Invitation) error {
+	sqlStatement := `
+	INSERT INTO trip_invitations (trip_id, username, role, invited_by)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (trip_id, username) DO UPDATE
+	SET role=EXCLUDED.role, invited_by=EXCLUDED.invited_by, created_at=now()
+	RETURNING id, created_at
+	`
+	err := p.db.QueryRow(sqlStatement, inv.TripID, inv.User, inv.Role, inv.InvitedBy).Scan(&inv.ID, &inv.CreatedAt)
+	inv.CreatedAt = inv.CreatedAt.UTC()
+	return err
+}
+
+// invitationColumns are the columns scanned by scanInvitation
+const invitationColumns = "id, trip_id, username, role, invited_by, created_at"
+
+func (p *postgresStore) Invitations(user string) (*InvitationCollection, error) {
+	return p.queryInvitations(`
+	SELECT `+invitationColumns+` FROM trip_invitations
+	WHERE username=$1
+	ORDER BY id`, user)
+}
+
+func (p *postgresStore) TripInvitations(id int64) (*InvitationCollection, error) {
+	return p.queryInvitations(`
+	SELECT `+invitationColumns+` FROM trip_invitations
+	WHERE trip_id=$1
+	ORDER BY id`, id)
+}
+
+func (p *postgresStore) queryInvitations(sqlStatement string, args ...interface{}) (*InvitationCollection, error) {
+
+	rows, err := p.db.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collection := InvitationCollection{Invitations: []Invitation{}}
+
+	for rows.Next() {
+		inv, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		collection.Invitations = append(collection.Invitations, *inv)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return &collection, nil
+}
+
+func (p *postgresStore) GetInvitation(id int64) (*Invitation, error) {
+
+	sqlStatement := `
+	SELECT ` + invitationColumns + ` FROM trip_invitations
+	WHERE id=$1
+	`
+
+	inv, err := scanInvitation(p.db.QueryRow(sqlStatement, id))
+	if err == sql.ErrNoRows {
+		return nil, errInvitationNotFound
+	}
+	return inv, err
+}
+
+func (p *postgresStore) AcceptInvitation(id int64) error {
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	INSERT INTO trip_members (trip_id, username, role)
+	SELECT trip_id, username, role FROM trip_invitations
+	WHERE id=$1
+	ON CONFLICT (trip_id, username) DO UPDATE
+	SET role=EXCLUDED.role`, id)
+
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`DELETE FROM trip_invitations WHERE id=$1`, id)
+	if err != nil {
+		return err
+	}
+	if err = expectAffected(result, errInvitationNotFound); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *postgresStore) DeleteInvitation(id int64) error {
+
+	result, err := p.db.Exec(`DELETE FROM trip_invitations WHERE id=$1`, id)
+
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result, errInvitationNotFound)
+}
+
+func scanInvitation(row rowScanner) (*Invitation, error) {
+	var inv Invitation
+
+	err := row.Scan(&inv.ID, &inv.TripID, &inv.User, &inv.Role, &inv.InvitedBy, &inv.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	inv.CreatedAt = inv.CreatedAt.UTC()
+	return &inv, nil
+}
+
+// uniqueViolation is the postgres error code of a duplicate key
+const uniqueViolation = "23505"
+
+func (p *postgresStore) SetProfile(profile *Profile) error {
+	sqlStatement := `
+	INSERT INTO users (username, handle, display_name)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (username) DO UPDATE
+	SET handle=EXCLUDED.handle, display_name=EXCLUDED.display_name
+	`
+	_, err := p.db.Exec(sqlStatement, profile.User, profile.Handle, profile.DisplayName)
+
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation {
+		return errHandleTaken
+	}
+	return err
+}
+
+func (p *postgresStore) GetProfile(user string) (*Profile, error) {
+	return p.queryProfile(`
+	SELECT username, handle, display_name FROM users
+	WHERE username=$1`, user)
+}
+
+func (p *postgresStore) ProfileByHandle(handle string) (*Profile, error) {
+	return p.queryProfile(`
+	SELECT username, handle, display_name FROM users
+	WHERE handle=$1`, handle)
+}
+
+func (p *postgresStore) queryProfile(sqlStatement string, arg interface{}) (*Profile, error) {
+	var profile Profile
+
+	err := p.db.QueryRow(sqlStatement, arg).Scan(&profile.User, &profile.Handle, &profile.DisplayName)
+	if err == sql.ErrNoRows {
+		return nil, errProfileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+func (p *postgresStore) PublicTrips(user string) ([]Trip, error) {
+
+	sqlStatement := `
+	SELECT ` + tripColumns + ` FROM trips
+	WHERE username=$1
+	AND visibility='public'
+	ORDER BY id`
+
+	rows, err := p.db.Query(sqlStatement, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trips := []Trip{}
+
+	for rows.Next() {
+		trip, err := scanTrip(rows)
+		if err != nil {
+			return nil, err
+		}
+		trips = append(trips, *trip)
+	}
+
+	return trips, rows.Err()
+}
+
+func (p *postgresStore) InsertShare(link *ShareLink) error {
+	sqlStatement := `
+	INSERT INTO share_links (username, token_hash, trip_id, filter, password_hash, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at
+	`
+	var passwordHash interface{}
+	if link.PasswordHash != "" {
+		passwordHash = link.PasswordHash
+	}
+
+	err := p.db.QueryRow(sqlStatement, link.User, link.TokenHash, link.TripID, link.Filter, passwordHash, link.ExpiresAt).
+		Scan(&link.ID, &link.CreatedAt)
+	link.CreatedAt = link.CreatedAt.UTC()
+	return err
+}
+
+// activeShare is the condition matching the share links that were neither revoked nor expired
+const activeShare = "revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())"
+
+func (p *postgresStore) ListShares(user string) (*ShareCollection, error) {
+
+	sqlStatement := `
+	SELECT ` + shareColumns + ` FROM share_links
+	WHERE username=$1
+	AND ` + activeShare + `
+	ORDER BY id`
+
+	rows, err := p.db.Query(sqlStatement, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collection := ShareCollection{Links: []ShareLink{}}
+
+	for rows.Next() {
+		link, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		collection.Links = append(collection.Links, *link)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return &collection, nil
+}
+
+func (p *postgresStore) RevokeShare(user string, id int64) error {
+
+	sqlStatement := `
+	UPDATE share_links
+	SET revoked_at=now()
+	WHERE username=$1
+	AND id=$2
+	AND revoked_at IS NULL
+	`
+	result, err := p.db.Exec(sqlStatement, user, id)
+
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result, errShareNotFound)
+}
+
+func (p *postgresStore) ShareByToken(tokenHash string) (*ShareLink, error) {
+
+	sqlStatement := `
+	SELECT ` + shareColumns + ` FROM share_links
+	WHERE token_hash=$1
+	AND ` + activeShare
+
+	link, err := scanShare(p.db.QueryRow(sqlStatement, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, errShareNotFound
+	}
+	return link, err
+}
+
+// shareColumns are the columns scanned by scanShare
+const shareColumns = "id, username, trip_id, filter, password_hash, expires_at, created_at"
+
+func scanShare(row rowScanner) (*ShareLink, error) {
+	var link ShareLink
+	var tripID sql.NullInt64
+	var passwordHash sql.NullString
+	var expiresAt pq.NullTime
+
+	err := row.Scan(&link.ID, &link.User, &tripID, &link.Filter, &passwordHash, &expiresAt, &link.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if tripID.Valid {
+		link.TripID = &tripID.Int64
+	}
+	link.PasswordHash = passwordHash.String
+	link.HasPassword = passwordHash.Valid
+	if expiresAt.Valid {
+		expires := expiresAt.Time.UTC()
+		link.ExpiresAt = &expires
+	}
+	link.CreatedAt = link.CreatedAt.UTC()
+	return &link, nil
+}
+
+// markerColumns are the columns scanned by scanMarker
+const markerColumns = "id, username, lat, long, note, visibility, created_at, updated_at, visited_at, visited_offset"
+
+// scanMarker reads the markerColumns of a row, followed by the extra columns of the query
+func scanMarker(row rowScanner, extra ...interface{}) (*Marker, error) {
+	var marker Marker
+	var visitedAt pq.NullTime
+	var visitedOffset sql.NullInt64
+
+	columns := append([]interface{}{&marker.ID, &marker.User, &marker.Lat, &marker.Lng, &marker.Note, &marker.Visibility,
+		&marker.CreatedAt, &marker.UpdatedAt, &visitedAt, &visitedOffset}, extra...)
+	if err := row.Scan(columns...); err != nil {
+		return nil, err
+	}
+
+	marker.CreatedAt, marker.UpdatedAt = marker.CreatedAt.UTC(), marker.UpdatedAt.UTC()
+	marker.VisitedAt = visitTime(visitedAt, visitedOffset)
+	return &marker, nil
+}
+
+// visitTime puts a visit time back in the time zone it was given in
+func visitTime(visitedAt pq.NullTime, visitedOffset sql.NullInt64) *time.Time {
+	if !visitedAt.Valid {
+		return nil
+	}
+	local := visitedAt.Time.In(time.FixedZone("", int(visitedOffset.Int64)))
+	return &local
+}
+
+// visitColumns splits the visit time in the instant and the offset of the time zone it was given in,
+// as postgres only keeps the instant
+func visitColumns(m *Marker) (interface{}, interface{}) {
+	if m.VisitedAt == nil {
+		return nil, nil
+	}
+	_, offset := m.VisitedAt.Zone()
+	return *m.VisitedAt, offset
+}
+
+// sortColumns returns the expression a listing is sorted by, its direction,
+// and the comparison selecting the rows following a cursor
+func sortColumns(order markerSort) (string, string, string) {
+	key := "id"
+	switch order.Field {
+	case sortCreatedAt, sortUpdatedAt:
+		key = order.Field
+	case sortVisitedAt:
+		key = "COALESCE(visited_at, '0001-01-01T00:00:00Z')"
+	}
+
+	if order.Descending {
+		return key, " DESC", "<"
+	}
+	return key, "", ">"
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTrip(row rowScanner) (*Trip, error) {
+	var trip Trip
+	var cover sql.NullInt64
+
+	err := row.Scan(&trip.ID, &trip.User, &trip.Name, &trip.Description, &trip.Visibility, &trip.StartDate, &trip.EndDate, &cover)
+	if err != nil {
+		return nil, err
+	}
+
+	if cover.Valid {
+		trip.CoverMarkerID = &cover.Int64
+	}
+	return &trip, nil
+}
+
+// nullDate stores an unknown date as NULL
+func nullDate(date string) interface{} {
+	if date == "" {
+		return nil
+	}
+	return date
+}
+
+// sqlConditions accumulates the WHERE clauses of a query with their positional arguments.
+// Clauses are written with ? placeholders, which are numbered in the order they are added.
+type sqlConditions struct {
+	clauses []string
+	args    []interface{}
+}
+
+func (c *sqlConditions) add(clause string, args ...interface{}) {
+	for _, arg := range args {
+		c.args = append(c.args, arg)
+		clause = strings.Replace(clause, "?", "$"+strconv.Itoa(len(c.args)), 1)
+	}
+	c.clauses = append(c.clauses, clause)
+}
+
+// arg registers an argument used outside of the WHERE clauses and returns its position
+func (c *sqlConditions) arg(value interface{}) string {
+	c.args = append(c.args, value)
+	return strconv.Itoa(len(c.args))
+}
+
+func (c *sqlConditions) where() string {
+	return strings.Join(c.clauses, "\n\tAND ")
+}
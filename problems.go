@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// problemBaseURI prefixes the type of every problem, clients should branch on the type rather than on the title
+const problemBaseURI = "https://trip-pin-points-markers.com/problems/"
+
+// problemType is one kind of error the service answers with
+type problemType struct {
+	slug   string
+	title  string
+	status int
+}
+
+var (
+	problemMissingAuthorization = problemType{"missing-authorization", "Missing authorization header", http.StatusBadRequest}
+	problemInvalidToken         = problemType{"invalid-token", "Invalid token", http.StatusUnauthorized}
+	problemInsufficientScope    = problemType{"insufficient-scope", "Insufficient scope", http.StatusForbidden}
+	problemSharePassword        = problemType{"share-password", "Share link password is missing or wrong", http.StatusUnauthorized}
+	problemTripRole             = problemType{"trip-role", "Your role on this trip does not allow this", http.StatusForbidden}
+	problemInvalidBody          = problemType{"invalid-body", "Could not parse given body", http.StatusBadRequest}
+	problemValidation           = problemType{"validation-failed", "Invalid fields in given body", http.StatusBadRequest}
+	problemInvalidQuery         = problemType{"invalid-query", "Could not parse given query", http.StatusBadRequest}
+	problemNotFound             = problemType{"not-found", "Resource not found", http.StatusNotFound}
+	problemMethodNotAllowed     = problemType{"method-not-allowed", "Method not allowed", http.StatusMethodNotAllowed}
+	problemStorage              = problemType{"storage-error", "Could not access the marker storage", http.StatusInternalServerError}
+	problemUnavailable          = problemType{"unavailable", "Service unavailable", http.StatusServiceUnavailable}
+)
+
+// problem is an error response body following RFC 7807
+type problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Errors    []fieldError `json:"errors,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+}
+
+// writeProblem answers the request with a problem of the given type.
+// cause is only logged, detail is what the client gets to read.
+func (s *server) writeProblem(w http.ResponseWriter, r *http.Request, kind problemType, detail string, cause error) {
+	s.writeProblemBody(w, r, kind, &problem{Detail: detail}, cause)
+}
+
+// writeBodyError answers a request whose body could not be parsed or failed validation
+func (s *server) writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	if invalid, ok := err.(*validationError); ok {
+		s.writeProblemBody(w, r, problemValidation, &problem{Detail: err.Error(), Errors: invalid.Fields}, err)
+		return
+	}
+	s.writeProblem(w, r, problemInvalidBody, "Body must be a valid JSON object", err)
+}
+
+// writeStoreError answers a failed store call, telling a missing resource apart from a storage failure
+func (s *server) writeStoreError(w http.ResponseWriter, r *http.Request, err error, notFound string) {
+	if err == errMarkerNotFound || err == errTripNotFound || err == errShareNotFound ||
+		err == errMemberNotFound || err == errInvitationNotFound || err == errProfileNotFound {
+		s.writeProblem(w, r, problemNotFound, notFound, err)
+		return
+	}
+	if err == errTripRole {
+		s.writeProblem(w, r, problemTripRole, "", err)
+		return
+	}
+	s.writeProblem(w, r, problemStorage, "", err)
+}
+
+func (s *server) writeProblemBody(w http.ResponseWriter, r *http.Request, kind problemType, p *problem, cause error) {
+	p.Type = problemBaseURI + kind.slug
+	p.Title = kind.title
+	p.Status = kind.status
+	p.Instance = r.URL.Path
+	p.RequestID = requestIDFrom(r.Context())
+
+	fields := []zap.Field{
+		zap.String("type", kind.slug),
+		zap.String("instance", p.Instance),
+		zap.String("request_id", p.RequestID),
+		zap.Error(cause),
+	}
+	if kind.status >= http.StatusInternalServerError {
+		s.logger.Error(kind.title, fields...)
+	} else {
+		s.logger.Info(kind.title, fields...)
+	}
+
+	response, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(kind.status)
+	fmt.Fprint(w, string(response))
+}
+
+func (s *server) handleRouteNotFound() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.writeProblem(w, r, problemNotFound, "No route matches "+r.URL.Path, nil)
+	}
+}
+
+func (s *server) handleMethodNotAllowed() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.writeProblem(w, r, problemMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path, nil)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Profile is the public identity of a user, the zid it belongs to is never handed out
+type Profile struct {
+	User        string `json:"-"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name"`
+}
+
+// PublicProfile is what anyone can see of a user: their public trips and a page of their public markers
+type PublicProfile struct {
+	Profile
+	Trips []Trip `json:"trips"`
+	MarkerCollection
+}
+
+// handlePattern is what a handle looks like, it is part of the public profile URL
+var handlePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{2,29}$`)
+
+// maxDisplayName is the longest display name a profile accepts, in characters
+const maxDisplayName = 100
+
+func (s *server) handleGetProfile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		profile, err := s.profiles.GetProfile(userZid)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find profile, choose a handle with PUT /profile")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, profile)
+	}
+}
+
+func (s *server) handleSetProfile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		profile, err := getNewProfile(r.Body, userZid)
+		if err != nil {
+			s.writeBodyError(w, r, err)
+			return
+		}
+
+		err = s.profiles.SetProfile(profile)
+		if err == errHandleTaken {
+			errs := &validationError{}
+			errs.add("handle", "is already taken")
+			s.writeBodyError(w, r, errs)
+			return
+		}
+		if err != nil {
+			s.writeStoreError(w, r, err, "")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, profile)
+	}
+}
+
+// handleGetPublicProfile answers anyone with the public trips and markers of a user, found by handle.
+// Markers are paginated with the limit and cursor queries.
+func (s *server) handleGetPublicProfile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		profile, err := s.profiles.ProfileByHandle(strings.ToLower(mux.Vars(r)["handle"]))
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find profile")
+			return
+		}
+
+		filter, err := sharedFilter("", r.URL.Query())
+		if err != nil {
+			s.writeProblem(w, r, problemInvalidQuery, err.Error(), err)
+			return
+		}
+		filter.Visibility = visibilityPublic
+
+		markers, err := s.store.List(profile.User, *filter)
+		if err != nil {
+			s.writeStoreError(w, r, err, "")
+			return
+		}
+		anonymize(markers.Markers)
+
+		trips, err := s.profiles.PublicTrips(profile.User)
+		if err != nil {
+			s.writeStoreError(w, r, err, "")
+			return
+		}
+		for i := range trips {
+			trips[i].User = ""
+			if err = s.hidePrivateCover(profile.User, &trips[i]); err != nil {
+				s.writeStoreError(w, r, err, "")
+				return
+			}
+		}
+
+		writeJSON(w, http.StatusOK, PublicProfile{Profile: *profile, Trips: trips, MarkerCollection: *markers})
+	}
+}
+
+// hidePrivateCover leaves out the cover of a public trip when its marker is not public itself
+func (s *server) hidePrivateCover(user string, trip *Trip) error {
+	if trip.CoverMarkerID == nil {
+		return nil
+	}
+
+	cover, err := s.store.Get(user, *trip.CoverMarkerID)
+	if err != nil && err != errMarkerNotFound {
+		return err
+	}
+	if err == errMarkerNotFound || cover.Visibility != visibilityPublic {
+		trip.CoverMarkerID = nil
+	}
+	return nil
+}
+
+// getNewProfile reads the handle and display name a user chose
+func getNewProfile(body io.Reader, user string) (*Profile, error) {
+
+	fields, err := decodeObject(body)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := Profile{User: user}
+	errs := &validationError{}
+
+	value, ok := fields["handle"]
+	if !ok || isJSONNull(value) {
+		errs.add("handle", "is required")
+	} else if err = json.Unmarshal(value, &profile.Handle); err != nil || !handlePattern.MatchString(profile.Handle) {
+		errs.add("handle", "must be 3 to 30 lowercase letters, digits, _ or -, starting with a letter or digit")
+	}
+
+	if value, ok := fields["display_name"]; ok && !isJSONNull(value) {
+		if err = json.Unmarshal(value, &profile.DisplayName); err != nil {
+			errs.add("display_name", "must be a string")
+		} else if utf8.RuneCountInString(profile.DisplayName) > maxDisplayName {
+			errs.add("display_name", fmt.Sprintf("must be at most %d characters long", maxDisplayName))
+		}
+	}
+
+	if err = errs.orNil(); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryProfile(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	s.profiles.SetProfile(&Profile{User: "someone-else", Handle: "taken"})
+
+	res := serveAs(s, "GET", "/profile", "")
+	assertProblem(t, res, problemNotFound)
+
+	invalidProfiles := []struct {
+		body   string
+		errors []fieldError
+	}{
+		{`{}`, []fieldError{{"handle", "is required"}}},
+		{`{"handle":"Otavio!","display_name":7}`, []fieldError{{"handle", "must be 3 to 30 lowercase letters, digits, _ or -, starting with a letter or digit"}, {"display_name", "must be a string"}}},
+		{`{"handle":"taken"}`, []fieldError{{"handle", "is already taken"}}},
+	}
+	for _, profile := range invalidProfiles {
+		res = serveAs(s, "PUT", "/profile", profile.body)
+		assertProblem(t, res, problemValidation, profile.errors...)
+	}
+
+	res = serveAs(s, "PUT", "/profile", `{"handle":"otavio","display_name":"Otávio"}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"handle":"otavio","display_name":"Otávio"}`, res.Body.String())
+
+	res = serveAs(s, "PUT", "/profile", `{"handle":"otavio_j"}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	res = serveAs(s, "GET", "/profile", "")
+	assert.Equal(t, `{"handle":"otavio_j","display_name":""}`, res.Body.String())
+}
+
+func TestMemoryPublicProfile(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	s.profiles.SetProfile(&Profile{User: "string3", Handle: "otavio", DisplayName: "Otávio"})
+	s.store.Insert(&Marker{User: "string3", Lat: 48.85, Lng: 2.35, Note: "paris", Visibility: visibilityPublic})
+	s.store.Insert(&Marker{User: "string3", Lat: 45.76, Lng: 4.83, Note: "home"})
+	s.store.Insert(&Marker{User: "string3", Lat: 40.41, Lng: -3.7, Note: "hotel", Visibility: visibilityPrivate})
+	s.store.Insert(&Marker{User: "someone-else", Lat: 41.38, Lng: 2.17, Note: "barcelona", Visibility: visibilityPublic})
+
+	paris, home := int64(1), int64(2)
+	s.trips.InsertTrip(&Trip{User: "string3", Name: "France", Visibility: visibilityPublic, CoverMarkerID: &paris})
+	s.trips.InsertTrip(&Trip{User: "string3", Name: "Family", Visibility: visibilityMembers})
+	s.trips.InsertTrip(&Trip{User: "string3", Name: "Lyon", Visibility: visibilityPublic, CoverMarkerID: &home})
+
+	res := openShare(s, "/u/Otavio", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"handle":"otavio","display_name":"Otávio","trips":[`+
+		`{"id":1,"name":"France","description":"","visibility":"public","cover_marker_id":1},`+
+		`{"id":3,"name":"Lyon","description":"","visibility":"public"}],"markers":[`+
+		`{"id":1,"lat":48.85,"lng":2.35,"note":"paris","visibility":"public","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}]}`,
+		res.Body.String())
+
+	res = openShare(s, "/u/nobody", "")
+	assertProblem(t, res, problemNotFound)
+	res = openShare(s, "/u/otavio?limit=0", "")
+	assertProblem(t, res, problemInvalidQuery)
+}
+
+func TestMemoryPrivateTripsAndMarkers(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	s.store.Insert(&Marker{User: "someone-else", Lat: 48.85, Lng: 2.35, Note: "paris"})
+	s.store.Insert(&Marker{User: "someone-else", Lat: 40.41, Lng: -3.7, Note: "hotel", Visibility: visibilityPrivate})
+	s.trips.InsertTrip(&Trip{User: "someone-else", Name: "Family trip"})
+	s.trips.InsertTrip(&Trip{User: "someone-else", Name: "Surprise", Visibility: visibilityPrivate})
+	for _, id := range []int64{1, 2} {
+		s.trips.SetTripMarkers("someone-else", id, "someone-else", []int64{1, 2})
+		s.trips.InsertInvitation(&Invitation{TripID: id, User: "string3", Role: roleEditor, InvitedBy: "someone-else"})
+		s.trips.AcceptInvitation(id)
+	}
+
+	res := serveAs(s, "GET", "/trip/1", "")
+	assert.Equal(t, `{"id":1,"user":"someone-else","name":"Family trip","description":"","visibility":"members","markers":[`+
+		`{"id":1,"user":"someone-else","lat":48.85,"lng":2.35,"note":"paris","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}]}`,
+		res.Body.String())
+	res = serveAs(s, "PATCH", "/trip/1/markers/2", `{"note":"found it"}`)
+	assertProblem(t, res, problemNotFound)
+
+	s.store.Insert(&Marker{User: "string3", Lat: 45.76, Lng: 4.83, Note: "lyon"})
+	res = serveAs(s, "PUT", "/trip/1/markers", `{"marker_ids":[2]}`)
+	assertProblem(t, res, problemValidation, fieldError{"marker_ids", "must only contain your markers"})
+	res = serveAs(s, "PUT", "/trip/1/markers", `{"marker_ids":[3,1]}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	markers, _ := s.trips.TripMarkers("someone-else", 1)
+	assert.Equal(t, []int64{3, 1, 2}, []int64{markers[0].ID, markers[1].ID, markers[2].ID})
+
+	res = serveAs(s, "GET", "/trip", "")
+	assert.Equal(t, `{"trips":[{"id":1,"user":"someone-else","name":"Family trip","description":"","visibility":"members"}]}`, res.Body.String())
+	res = serveAs(s, "GET", "/trip/2", "")
+	assertProblem(t, res, problemNotFound)
+
+	res = serveAs(s, "PUT", "/marker", `{"lat":1,"lng":1,"visibility":"friends"}`)
+	assertProblem(t, res, problemValidation, fieldError{"visibility", "must be one of private, members and public"})
+}
+
+func TestMemoryUpdateKeepsVisibility(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	s.store.Insert(&Marker{User: "string3", Lat: 1, Lng: 1, Note: "x", Visibility: visibilityPrivate})
+	s.trips.InsertTrip(&Trip{User: "string3", Name: "T", Visibility: visibilityPrivate})
+
+	res := serveAs(s, "PUT", "/marker/1", `{"lat":2,"lng":2,"note":"y"}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), `"visibility":"private"`)
+	res = serveAs(s, "POST", "/marker/batch", `{"operations":[{"op":"update","id":1,"marker":{"lat":3,"lng":3}}]}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	marker, _ := s.store.Get("string3", 1)
+	assert.Equal(t, visibilityPrivate, marker.Visibility)
+
+	res = serveAs(s, "PUT", "/trip/1", `{"name":"T2"}`)
+	assert.Equal(t, `{"id":1,"user":"string3","name":"T2","description":"","visibility":"private"}`, res.Body.String())
+	res = serveAs(s, "PUT", "/trip/1", `{"name":"T3","visibility":"public"}`)
+	assert.Contains(t, res.Body.String(), `"visibility":"public"`)
+}
+
+func TestProfileQueries(t *testing.T) {
+	s, mock := getMockServer()
+	defer s.finalize()
+
+	mock.ExpectExec(`INSERT INTO users \(username, handle, display_name\)\s+VALUES \(\$1, \$2, \$3\)\s+ON CONFLICT \(username\) DO UPDATE`).
+		WithArgs("string3", "taken", "").
+		WillReturnError(&pq.Error{Code: uniqueViolation})
+
+	res := serveAs(s, "PUT", "/profile", `{"handle":"taken"}`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assertProblem(t, res, problemValidation, fieldError{"handle", "is already taken"})
+
+	mock.ExpectQuery(`SELECT username, handle, display_name FROM users\s+WHERE handle=\$1`).
+		WithArgs("otavio").
+		WillReturnError(sql.ErrNoRows)
+
+	res = openShare(s, "/u/otavio", "")
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assertProblem(t, res, problemNotFound)
+
+	mock.ExpectQuery(`SELECT username, handle, display_name FROM users\s+WHERE handle=\$1`).
+		WithArgs("otavio").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "handle", "display_name"}).AddRow("string3", "otavio", "Otávio"))
+	mock.ExpectPrepare(`FROM markers\s+WHERE username=\$1\s+AND deleted_at IS NULL\s+AND visibility=\$2`).
+		ExpectQuery().
+		WithArgs("string3", "public").
+		WillReturnRows(markerRows().AddRow(3, "string3", 48.85, 2.35, "paris", "public", stubMarkerTime, stubMarkerTime, nil, nil))
+	mock.ExpectQuery(`FROM trips\s+WHERE username=\$1\s+AND visibility='public'`).
+		WithArgs("string3").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "description", "visibility", "start_date", "end_date", "cover_marker_id"}).
+			AddRow(7, "string3", "France", "", "public", "", "", nil))
+
+	res = openShare(s, "/u/otavio", "")
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, `{"handle":"otavio","display_name":"Otávio","trips":[{"id":7,"name":"France","description":"","visibility":"public"}],"markers":[`+
+		`{"id":3,"lat":48.85,"lng":2.35,"note":"paris","visibility":"public","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}]}`,
+		res.Body.String())
+}
@@ -1,13 +1,68 @@
 package main
 
+// routes registers every endpoint of the service.
+// Only the health checks, share links and public profiles are public, everything else goes on the api subrouter,
+// which requires a valid token and declares the scope each route needs.
 func (s *server) routes() {
 
+	s.router.Use(s.withRequestID)
+	s.router.NotFoundHandler = s.withRequestID(s.handleRouteNotFound())
+	s.router.MethodNotAllowedHandler = s.withRequestID(s.handleMethodNotAllowed())
+
 	s.router.HandleFunc("/healthcheck", s.handleHealthcheck()).Methods("GET")
 	s.router.HandleFunc("/pingDB", s.handlePingDB()).Methods("GET")
+	s.router.HandleFunc("/shared/{token}", s.handleGetShared()).Methods("GET")
+	s.router.HandleFunc("/u/{handle}", s.handleGetPublicProfile()).Methods("GET")
+
+	api := s.router.NewRoute().Subrouter()
+	api.Use(s.authenticate)
+
+	api.HandleFunc("/marker", s.requireScope(scopeMarkersRead, s.handleGetAllMarkers())).Methods("GET")
+	api.HandleFunc("/marker", s.requireScope(scopeMarkersWrite, s.handleInsertMarker())).Methods("PUT")
+	api.HandleFunc("/marker/batch", s.requireScope(scopeMarkersWrite, s.handleBatch())).Methods("POST")
+	api.HandleFunc("/marker/near", s.requireScope(scopeMarkersRead, s.handleGetNearMarkers())).Methods("GET")
+	api.HandleFunc("/marker/{id:[0-9]+}", s.requireScope(scopeMarkersRead, s.handleGetMarkerByID())).Methods("GET")
+	api.HandleFunc("/marker/{id:[0-9]+}", s.requireScope(scopeMarkersWrite, s.handleUpdateMarker())).Methods("PUT")
+	api.HandleFunc("/marker/{id:[0-9]+}", s.requireScope(scopeMarkersWrite, s.handlePatchMarker())).Methods("PATCH")
+	api.HandleFunc("/marker/{id:[0-9]+}", s.requireScope(scopeMarkersWrite, s.handleDeleteMarkerByID())).Methods("DELETE")
+	api.HandleFunc("/marker/{id:[0-9]+}/history", s.requireScope(scopeMarkersRead, s.handleGetMarkerHistory())).Methods("GET")
+	api.HandleFunc("/marker/{id:[0-9]+}/revert", s.requireScope(scopeMarkersWrite, s.handleRevertMarker())).Methods("POST")
+	api.HandleFunc("/marker/{lat}/{lng}", s.requireScope(scopeMarkersRead, s.handleGetSingleMarker())).Methods("GET")
+	api.HandleFunc("/marker/{lat}/{lng}", s.requireScope(scopeMarkersWrite, s.handleDeleteMarker())).Methods("DELETE")
+
+	api.HandleFunc("/trash", s.requireScope(scopeMarkersRead, s.handleGetTrash())).Methods("GET")
+	api.HandleFunc("/trash/{id:[0-9]+}/restore", s.requireScope(scopeMarkersWrite, s.handleRestoreMarker())).Methods("POST")
+	api.HandleFunc("/trash/purge", s.requireScope(scopeAdmin, s.handlePurgeTrash())).Methods("POST")
+
+	api.HandleFunc("/trip", s.requireScope(scopeMarkersRead, s.handleGetAllTrips())).Methods("GET")
+	api.HandleFunc("/trip", s.requireScope(scopeMarkersWrite, s.handleInsertTrip())).Methods("PUT")
+	api.HandleFunc("/trip/{id:[0-9]+}", s.requireScope(scopeMarkersRead, s.handleGetTrip())).Methods("GET")
+	api.HandleFunc("/trip/{id:[0-9]+}", s.requireScope(scopeMarkersWrite, s.handleUpdateTrip())).Methods("PUT")
+	api.HandleFunc("/trip/{id:[0-9]+}", s.requireScope(scopeMarkersWrite, s.handleDeleteTrip())).Methods("DELETE")
+	api.HandleFunc("/trip/{id:[0-9]+}/markers", s.requireScope(scopeMarkersWrite, s.handleSetTripMarkers())).Methods("PUT")
+	api.HandleFunc("/trip/{id:[0-9]+}/markers/{marker_id:[0-9]+}", s.requireScope(scopeMarkersWrite, s.handlePatchTripMarker())).Methods("PATCH")
+	api.HandleFunc("/trip/{id:[0-9]+}/members", s.requireScope(scopeMarkersRead, s.handleGetTripMembers())).Methods("GET")
+	api.HandleFunc("/trip/{id:[0-9]+}/members/{zid}", s.requireScope(scopeMarkersWrite, s.handleUpdateTripMember())).Methods("PUT")
+	api.HandleFunc("/trip/{id:[0-9]+}/members/{zid}", s.requireScope(scopeMarkersWrite, s.handleRemoveTripMember())).Methods("DELETE")
+	api.HandleFunc("/trip/{id:[0-9]+}/invitations", s.requireScope(scopeMarkersRead, s.handleGetTripInvitations())).Methods("GET")
+	api.HandleFunc("/trip/{id:[0-9]+}/invitations", s.requireScope(scopeMarkersWrite, s.handleInsertInvitation())).Methods("PUT")
+
+	api.HandleFunc("/invitation", s.requireScope(scopeMarkersRead, s.handleGetInvitations())).Methods("GET")
+	api.HandleFunc("/invitation/{id:[0-9]+}", s.requireScope(scopeMarkersWrite, s.handleDeleteInvitation())).Methods("DELETE")
+	api.HandleFunc("/invitation/{id:[0-9]+}/accept", s.requireScope(scopeMarkersWrite, s.handleAcceptInvitation())).Methods("POST")
+
+	api.HandleFunc("/profile", s.requireScope(scopeMarkersRead, s.handleGetProfile())).Methods("GET")
+	api.HandleFunc("/profile", s.requireScope(scopeMarkersWrite, s.handleSetProfile())).Methods("PUT")
+
+	api.HandleFunc("/share", s.requireScope(scopeMarkersRead, s.handleGetShares())).Methods("GET")
+	api.HandleFunc("/share", s.requireScope(scopeMarkersWrite, s.handleInsertShare())).Methods("PUT")
+	api.HandleFunc("/share/{id:[0-9]+}", s.requireScope(scopeMarkersWrite, s.handleRevokeShare())).Methods("DELETE")
 
-	s.router.HandleFunc("/marker", s.handleGetAllMarkers()).Methods("GET")
-	s.router.HandleFunc("/marker", s.handleInsertMarker()).Methods("PUT")
-	s.router.HandleFunc("/marker/{lat}/{lng}", s.handleGetSingleMarker()).Methods("GET")
-	s.router.HandleFunc("/marker/{lat}/{lng}", s.handleDeleteMarker()).Methods("DELETE")
+	api.HandleFunc("/import/gpx", s.requireScope(scopeMarkersWrite, s.handleImportGPX())).Methods("POST")
+	api.HandleFunc("/export/gpx", s.requireScope(scopeMarkersRead, s.handleExportGPX())).Methods("GET")
+	api.HandleFunc("/import/kml", s.requireScope(scopeMarkersWrite, s.handleImportKML())).Methods("POST")
+	api.HandleFunc("/export/kml", s.requireScope(scopeMarkersRead, s.handleExportKML())).Methods("GET")
+	api.HandleFunc("/import/csv", s.requireScope(scopeMarkersWrite, s.handleImportCSV())).Methods("POST")
+	api.HandleFunc("/export/csv", s.requireScope(scopeMarkersRead, s.handleExportCSV())).Methods("GET")
 
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Scopes a token can be granted in its scopes claim
+const (
+	scopeMarkersRead  = "markers:read"
+	scopeMarkersWrite = "markers:write"
+	scopeAdmin        = "admin"
+)
+
+// impliedScopes lists the scopes granted along with another one.
+// user is what the auth service hands to the mobile app, admin is granted everything.
+var impliedScopes = map[string][]string{
+	"user":     {scopeMarkersRead, scopeMarkersWrite},
+	scopeAdmin: {scopeMarkersRead, scopeMarkersWrite},
+}
+
+// hasScope tells whether the principal was granted scope, directly or through another scope implying it
+func (p *principal) hasScope(scope string) bool {
+	for _, granted := range p.Scopes {
+		if granted == scope {
+			return true
+		}
+		for _, implied := range impliedScopes[granted] {
+			if implied == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requireScope only lets requests whose principal has scope reach next, it must run behind authenticate
+func (s *server) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := principalFrom(r.Context())
+		if user == nil || !user.hasScope(scope) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+			s.writeProblem(w, r, problemInsufficientScope, fmt.Sprintf("Token must have the %s scope", scope), nil)
+			return
+		}
+		next(w, r)
+	}
+}
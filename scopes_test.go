@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHasScope(t *testing.T) {
+	cases := []struct {
+		granted []string
+		scope   string
+		allowed bool
+	}{
+		{[]string{"markers:read"}, "markers:read", true},
+		{[]string{"markers:read"}, "markers:write", false},
+		{[]string{"markers:write"}, "markers:read", false},
+		{[]string{"user"}, "markers:read", true},
+		{[]string{"user"}, "markers:write", true},
+		{[]string{"user"}, "admin", false},
+		{[]string{"admin"}, "markers:write", true},
+		{[]string{"admin"}, "admin", true},
+		{nil, "markers:read", false},
+	}
+
+	for _, c := range cases {
+		user := &principal{ZID: "string3", Scopes: c.granted}
+		assert.Equal(t, c.allowed, user.hasScope(c.scope), "%v has %s", c.granted, c.scope)
+	}
+}
+
+func TestRoutesRequireScopes(t *testing.T) {
+	s := getSignedMemoryServer()
+	defer s.finalize()
+
+	requests := []struct {
+		scopes []string
+		method string
+		url    string
+		body   string
+		status int
+	}{
+		{[]string{"markers:read"}, "GET", "/marker", "", http.StatusOK},
+		{[]string{"markers:read"}, "PUT", "/marker", `{"lat":1,"lng":2}`, http.StatusForbidden},
+		{[]string{"markers:read"}, "DELETE", "/marker/1", "", http.StatusForbidden},
+		{[]string{"markers:write"}, "PUT", "/marker", `{"lat":1,"lng":2}`, http.StatusCreated},
+		{[]string{"markers:write"}, "GET", "/marker/1", "", http.StatusForbidden},
+		{[]string{"markers:write"}, "PATCH", "/marker/1", `{"note":"a"}`, http.StatusOK},
+		{[]string{"admin"}, "GET", "/marker/1", "", http.StatusOK},
+		{[]string{"user"}, "DELETE", "/marker/1", "", http.StatusNoContent},
+		{[]string{}, "GET", "/marker", "", http.StatusForbidden},
+	}
+
+	for _, tt := range requests {
+		claims := validClaims("string3")
+		claims["scopes"] = tt.scopes
+
+		req, _ := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+		req.Header.Set("Authorization", authHeaderFor(t, claims))
+		res := httptest.NewRecorder()
+		s.router.ServeHTTP(res, req)
+
+		assert.Equal(t, tt.status, res.Code, "%s %s with %v", tt.method, tt.url, tt.scopes)
+	}
+}
+
+func TestInsufficientScopeProblem(t *testing.T) {
+	s := getSignedMemoryServer()
+	defer s.finalize()
+
+	claims := validClaims("string3")
+	claims["scopes"] = []string{"markers:read"}
+
+	req, _ := http.NewRequest("DELETE", "/marker/1/2", nil)
+	req.Header.Set("Authorization", authHeaderFor(t, claims))
+	req.Header.Set("X-Request-ID", "test-request")
+	res := httptest.NewRecorder()
+	s.router.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusForbidden, res.Code)
+	assert.Equal(t, `Bearer error="insufficient_scope", scope="markers:write"`, res.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, `{"type":"https://trip-pin-points-markers.com/problems/insufficient-scope","title":"Insufficient scope","status":403,"detail":"Token must have the markers:write scope","instance":"/marker/1/2","request_id":"test-request"}`, res.Body.String())
+}
+
+func TestPurgeTrashRequiresAdmin(t *testing.T) {
+	s := getSignedMemoryServer()
+	defer s.finalize()
+
+	s.purger, _ = newTrashPurger(s.store, s.logger)
+	s.store.Insert(&Marker{User: "someone-else", Lat: 1, Lng: 1})
+	s.store.Delete("someone-else", 1)
+
+	requests := []struct {
+		scope  string
+		status int
+	}{
+		{"user", http.StatusForbidden},
+		{"admin", http.StatusOK},
+	}
+
+	for _, tt := range requests {
+		claims := validClaims("string3")
+		claims["scopes"] = []string{tt.scope}
+
+		req, _ := http.NewRequest("POST", "/trash/purge", nil)
+		req.Header.Set("Authorization", authHeaderFor(t, claims))
+		res := httptest.NewRecorder()
+		s.router.ServeHTTP(res, req)
+
+		assert.Equal(t, tt.status, res.Code, tt.scope)
+	}
+
+	_, err := s.store.Restore("someone-else", 1)
+	assert.Equal(t, errMarkerNotFound, err)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ShareCollection represents the active share links of a user
+type ShareCollection struct {
+	Links []ShareLink `json:"links"`
+}
+
+// ShareLink gives read only access, without a token, to a trip or to the markers matching a filter.
+// Only the hash of its token is kept, the token itself is handed out once when the link is created.
+type ShareLink struct {
+	ID   int64  `json:"id"`
+	User string `json:"user"`
+
+	// TripID is the shared trip, when it is not set the markers matching Filter are shared
+	TripID *int64 `json:"trip_id,omitempty"`
+	// Filter is a marker listing query such as bbox=2,48,3,49&sort=-visited_at, empty to share every marker
+	Filter string `json:"filter,omitempty"`
+
+	HasPassword bool       `json:"has_password"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+
+	// Token is only set in the answer to the creation of the link
+	Token string `json:"token,omitempty"`
+
+	TokenHash    string `json:"-"`
+	PasswordHash string `json:"-"`
+}
+
+// sharePasswordHeader carries the password of a protected share link
+const sharePasswordHeader = "X-Share-Password"
+
+// minSharePassword is the shortest password a share link accepts
+const minSharePassword = 8
+
+// shareFilterParams are the listing queries a shared marker set can be narrowed with,
+// pagination is left to whoever opens the link
+var shareFilterParams = map[string]bool{"bbox": true, "visited_after": true, "visited_before": true, "sort": true}
+
+func (s *server) handleInsertShare() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		link, password, err := getNewShare(r.Body, userZid)
+		if err != nil {
+			s.writeBodyError(w, r, err)
+			return
+		}
+
+		if err = s.checkSharedTrip(link); err != nil {
+			s.writeShareError(w, r, err)
+			return
+		}
+
+		if password != "" {
+			hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+			if err != nil {
+				s.writeProblem(w, r, problemStorage, "", err)
+				return
+			}
+			link.PasswordHash = string(hash)
+			link.HasPassword = true
+		}
+
+		if link.Token, link.TokenHash, err = newShareToken(); err != nil {
+			s.writeProblem(w, r, problemStorage, "", err)
+			return
+		}
+
+		if err = s.shares.InsertShare(link); err != nil {
+			s.writeShareError(w, r, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, link)
+	}
+}
+
+func (s *server) handleGetShares() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		links, err := s.shares.ListShares(userZid)
+		if err != nil {
+			s.writeStoreError(w, r, err, "")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, links)
+	}
+}
+
+func (s *server) handleRevokeShare() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		id, err := getShareID(mux.Vars(r))
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find share link", err)
+			return
+		}
+
+		if err = s.shares.RevokeShare(userZid, id); err != nil {
+			s.writeStoreError(w, r, err, "Could not find share link")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleGetShared answers the public side of a share link, with the shared trip or markers.
+// Private markers are never shared, a trip only shows the other members' public markers.
+// Unknown, expired and revoked tokens all look the same.
+func (s *server) handleGetShared() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		link, err := s.shares.ShareByToken(hashShareToken(mux.Vars(r)["token"]))
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find share link")
+			return
+		}
+
+		if link.PasswordHash != "" {
+			password := r.Header.Get(sharePasswordHeader)
+			if err = bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password)); err != nil {
+				s.writeProblem(w, r, problemSharePassword, "Send the password of the link in the "+sharePasswordHeader+" header", nil)
+				return
+			}
+		}
+
+		if link.TripID != nil {
+			trip, err := s.tripWithMarkers(link.User, *link.TripID, link.User)
+			if err != nil {
+				s.writeStoreError(w, r, err, "Could not find share link")
+				return
+			}
+			trip.User = ""
+			trip.Markers = sharedMarkers(trip.Markers, link.User)
+			anonymize(trip.Markers)
+			writeJSON(w, http.StatusOK, trip)
+			return
+		}
+
+		filter, err := sharedFilter(link.Filter, r.URL.Query())
+		if err != nil {
+			s.writeProblem(w, r, problemInvalidQuery, err.Error(), err)
+			return
+		}
+
+		format, err := listingFormat(r)
+		if err != nil {
+			s.writeProblem(w, r, problemInvalidQuery, err.Error(), err)
+			return
+		}
+
+		markers, err := s.store.List(link.User, *filter)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find markers")
+			return
+		}
+		anonymize(markers.Markers)
+
+		writeMarkers(w, format, markers)
+	}
+}
+
+// sharedMarkers leaves out the markers of a shared trip its owner may not hand out:
+// private ones and those of other members that are not public
+func sharedMarkers(markers []Marker, owner string) []Marker {
+	shared := markers[:0]
+	for _, m := range markers {
+		if m.Visibility == visibilityPublic || (m.User == owner && m.Visibility != visibilityPrivate) {
+			shared = append(shared, m)
+		}
+	}
+	return shared
+}
+
+// anonymize hides the owner of shared markers, the zid is never handed out publicly
+func anonymize(markers []Marker) {
+	for i := range markers {
+		markers[i].User = ""
+	}
+}
+
+// sharedFilter is the filter of a share link, paginated with the limit and cursor of the request.
+// It never lists private markers.
+func sharedFilter(shared string, request url.Values) (*MarkerFilter, error) {
+	values, err := url.ParseQuery(shared)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, param := range []string{"limit", "cursor"} {
+		if value := request.Get(param); value != "" {
+			values.Set(param, value)
+		}
+	}
+
+	filter, err := getMarkerFilter(values)
+	if err != nil {
+		return nil, err
+	}
+	filter.HidePrivate = true
+	return filter, nil
+}
+
+// checkSharedTrip makes sure a shared trip belongs to the user sharing it
+func (s *server) checkSharedTrip(link *ShareLink) error {
+	if link.TripID == nil {
+		return nil
+	}
+
+	_, err := s.trips.GetTrip(link.User, *link.TripID)
+	if err == errTripNotFound {
+		errs := &validationError{}
+		errs.add("trip_id", "must be one of your trips")
+		return errs
+	}
+	return err
+}
+
+// writeShareError answers a failed share link change, where a missing trip is a mistake of the body
+func (s *server) writeShareError(w http.ResponseWriter, r *http.Request, err error) {
+	if _, ok := err.(*validationError); ok {
+		s.writeBodyError(w, r, err)
+		return
+	}
+	s.writeStoreError(w, r, err, "")
+}
+
+func getShareID(params map[string]string) (int64, error) {
+	return strconv.ParseInt(params["id"], 10, 64)
+}
+
+// getNewShare reads a share link to create along with its password, a link shares either a trip or a filter
+func getNewShare(body io.Reader, user string) (*ShareLink, string, error) {
+
+	fields, err := decodeObject(body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	link := ShareLink{User: user}
+	errs := &validationError{}
+
+	if value, ok := fields["trip_id"]; ok && !isJSONNull(value) {
+		var tripID int64
+		if err = json.Unmarshal(value, &tripID); err != nil {
+			errs.add("trip_id", "must be a trip id")
+		}
+		link.TripID = &tripID
+	}
+
+	value, sharesMarkers := fields["filter"]
+	if sharesMarkers && !isJSONNull(value) {
+		if err = json.Unmarshal(value, &link.Filter); err != nil {
+			errs.add("filter", "must be a string")
+		} else if link.Filter, err = canonicalShareFilter(link.Filter); err != nil {
+			errs.add("filter", err.Error())
+		}
+	}
+
+	if link.TripID != nil && sharesMarkers {
+		errs.add("filter", "can not be given along with trip_id")
+	}
+	if link.TripID == nil && !sharesMarkers {
+		errs.add("trip_id", "is required when no filter is given")
+	}
+
+	if value, ok := fields["expires_at"]; ok && !isJSONNull(value) {
+		var expiresAt time.Time
+		if err = json.Unmarshal(value, &expiresAt); err != nil {
+			errs.add("expires_at", "must be a RFC 3339 time with its offset")
+		} else if !expiresAt.After(time.Now()) {
+			errs.add("expires_at", "must be in the future")
+		}
+		expiresAt = expiresAt.UTC()
+		link.ExpiresAt = &expiresAt
+	}
+
+	var password string
+	if value, ok := fields["password"]; ok && !isJSONNull(value) {
+		if err = json.Unmarshal(value, &password); err != nil {
+			errs.add("password", "must be a string")
+		} else if len(password) < minSharePassword {
+			errs.add("password", fmt.Sprintf("must be at least %d characters long", minSharePassword))
+		}
+	}
+
+	if err = errs.orNil(); err != nil {
+		return nil, "", err
+	}
+	return &link, password, nil
+}
+
+// canonicalShareFilter checks a shared marker filter and writes it back in a stable form
+func canonicalShareFilter(raw string) (string, error) {
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		return "", errors.New("must be a query string")
+	}
+
+	for param := range values {
+		if !shareFilterParams[param] {
+			return "", errors.New("must only use bbox, visited_after, visited_before and sort")
+		}
+	}
+
+	if _, err = getMarkerFilter(values); err != nil {
+		return "", err
+	}
+	return values.Encode(), nil
+}
+
+// newShareToken returns an unguessable token along with the hash it is stored as
+func newShareToken() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	return token, hashShareToken(token), nil
+}
+
+func hashShareToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
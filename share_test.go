@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// openShare opens a share link the way someone without an account does
+func openShare(s *server, url string, password string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", url, nil)
+	if password != "" {
+		req.Header.Set(sharePasswordHeader, password)
+	}
+	res := httptest.NewRecorder()
+	s.router.ServeHTTP(res, req)
+	return res
+}
+
+func createShare(t *testing.T, s *server, body string) ShareLink {
+	t.Helper()
+
+	res := serveAs(s, "PUT", "/share", body)
+	assert.Equal(t, http.StatusCreated, res.Code, body)
+
+	var link ShareLink
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &link))
+	assert.Len(t, link.Token, 43)
+	return link
+}
+
+func TestMemoryShareLinks(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	s.store.Insert(&Marker{User: "string3", Lat: 48.85, Lng: 2.35, Note: "paris"})
+	s.store.Insert(&Marker{User: "string3", Lat: 45.76, Lng: 4.83, Note: "lyon"})
+	s.store.Insert(&Marker{User: "string3", Lat: 40.41, Lng: -3.7, Note: "madrid"})
+	s.store.Insert(&Marker{User: "string3", Lat: 40.42, Lng: -3.71, Note: "hotel", Visibility: visibilityPrivate})
+	s.store.Insert(&Marker{User: "someone-else", Lat: 43.3, Lng: 5.37, Note: "marseille", Visibility: visibilityPublic})
+	s.store.Insert(&Marker{User: "someone-else", Lat: 43.7, Lng: 7.27, Note: "nice"})
+	s.trips.InsertTrip(&Trip{User: "string3", Name: "France"})
+	s.trips.SetTripMarkers("string3", 1, "someone-else", []int64{5, 6})
+	s.trips.SetTripMarkers("string3", 1, "string3", []int64{2, 1, 4, 5, 6})
+
+	trip := createShare(t, s, `{"trip_id":1}`)
+	res := openShare(s, "/shared/"+trip.Token, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"id":1,"name":"France","description":"","visibility":"members","markers":[`+
+		`{"id":2,"lat":45.76,"lng":4.83,"note":"lyon","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"},`+
+		`{"id":1,"lat":48.85,"lng":2.35,"note":"paris","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"},`+
+		`{"id":5,"lat":43.3,"lng":5.37,"note":"marseille","visibility":"public","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}]}`,
+		res.Body.String())
+
+	spain := createShare(t, s, `{"filter":"sort=-id&bbox=-10,35,4,44","password":"hola mundo"}`)
+	assert.Equal(t, "bbox=-10%2C35%2C4%2C44&sort=-id", spain.Filter)
+	assert.True(t, spain.HasPassword)
+
+	for _, password := range []string{"", "bonjour!"} {
+		res = openShare(s, "/shared/"+spain.Token, password)
+		assertProblem(t, res, problemSharePassword)
+	}
+	res = openShare(s, "/shared/"+spain.Token+"?limit=5&bbox=-180,-90,180,90", "hola mundo")
+	assert.Equal(t, `{"markers":[{"id":3,"lat":40.41,"lng":-3.7,"note":"madrid","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}]}`, res.Body.String())
+
+	everything := createShare(t, s, `{"filter":"","expires_at":"`+time.Now().Add(time.Hour).Format(time.RFC3339)+`"}`)
+	res = openShare(s, "/shared/"+everything.Token+"?limit=2", "")
+	var page MarkerCollection
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &page))
+	assert.Len(t, page.Markers, 2)
+	assert.NotEmpty(t, page.NextCursor)
+
+	res = serveAs(s, "GET", "/share", "")
+	var links ShareCollection
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &links))
+	assert.Len(t, links.Links, 3)
+	for _, link := range links.Links {
+		assert.Empty(t, link.Token)
+	}
+
+	store := s.store.(*memoryStore)
+	store.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	res = openShare(s, "/shared/"+everything.Token, "")
+	assertProblem(t, res, problemNotFound)
+	store.now = func() time.Time { return stubMarkerTime }
+
+	res = serveAs(s, "DELETE", "/share/1", "")
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	res = openShare(s, "/shared/"+trip.Token, "")
+	assertProblem(t, res, problemNotFound)
+	res = serveAs(s, "DELETE", "/share/1", "")
+	assertProblem(t, res, problemNotFound)
+
+	res = openShare(s, "/shared/not-a-token", "")
+	assertProblem(t, res, problemNotFound)
+
+	// links can not be used to change anything
+	req, _ := http.NewRequest("DELETE", "/shared/"+spain.Token, nil)
+	res = httptest.NewRecorder()
+	s.router.ServeHTTP(res, req)
+	assertProblem(t, res, problemMethodNotAllowed)
+}
+
+func TestMemoryInsertShareValidation(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	s.trips.InsertTrip(&Trip{User: "someone-else", Name: "Not mine"})
+
+	invalidShares := []struct {
+		body   string
+		errors []fieldError
+	}{
+		{`{}`, []fieldError{{"trip_id", "is required when no filter is given"}}},
+		{`{"trip_id":1}`, []fieldError{{"trip_id", "must be one of your trips"}}},
+		{`{"trip_id":1,"filter":"sort=id"}`, []fieldError{{"filter", "can not be given along with trip_id"}}},
+		{`{"filter":"limit=5"}`, []fieldError{{"filter", "must only use bbox, visited_after, visited_before and sort"}}},
+		{`{"filter":"sort=name"}`, []fieldError{{"filter", errInvalidSort.Error()}}},
+		{`{"filter":"","expires_at":"2019-03-01T00:00:00Z","password":"short"}`, []fieldError{{"expires_at", "must be in the future"}, {"password", "must be at least 8 characters long"}}},
+	}
+
+	for _, share := range invalidShares {
+		res := serveAs(s, "PUT", "/share", share.body)
+		assertProblem(t, res, problemValidation, share.errors...)
+	}
+}
+
+func TestShareLinkQueries(t *testing.T) {
+	s, mock := getMockServer()
+	defer s.finalize()
+
+	mock.ExpectQuery(`FROM trips\s+WHERE username=\$1\s+AND id=\$2`).
+		WithArgs("string3", 7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "description", "visibility", "start_date", "end_date", "cover_marker_id"}).
+			AddRow(7, "string3", "France", "", "members", "", "", nil))
+	mock.ExpectQuery("INSERT INTO share_links").
+		WithArgs("string3", sqlmock.AnyArg(), 7, "", nil, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(3, stubMarkerTime))
+
+	res := serveAs(s, "PUT", "/share", `{"trip_id":7}`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, http.StatusCreated, res.Code)
+
+	var link ShareLink
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &link))
+
+	mock.ExpectQuery(`FROM share_links\s+WHERE token_hash=\$1\s+AND revoked_at IS NULL AND \(expires_at IS NULL OR expires_at > now\(\)\)`).
+		WithArgs(hashShareToken(link.Token)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "trip_id", "filter", "password_hash", "expires_at", "created_at"}))
+
+	res = openShare(s, "/shared/"+link.Token, "")
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assertProblem(t, res, problemNotFound)
+
+	mock.ExpectQuery(`FROM share_links\s+WHERE token_hash=\$1`).
+		WithArgs(hashShareToken("filtered")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "trip_id", "filter", "password_hash", "expires_at", "created_at"}).
+			AddRow(4, "string3", nil, "sort=id", "", nil, stubMarkerTime))
+	mock.ExpectPrepare(`WHERE username=\$1\s+AND deleted_at IS NULL\s+AND visibility<>'private'\s+ORDER BY id`).
+		ExpectQuery().
+		WithArgs("string3").
+		WillReturnRows(markerRows().AddRow(1, "string3", 48.85, 2.35, "paris", "members", stubMarkerTime, stubMarkerTime, nil, nil))
+
+	res = openShare(s, "/shared/filtered", "")
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, `{"markers":[{"id":1,"lat":48.85,"lng":2.35,"note":"paris","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}]}`, res.Body.String())
+
+	mock.ExpectExec(`UPDATE share_links\s+SET revoked_at=now\(\)\s+WHERE username=\$1\s+AND id=\$2`).
+		WithArgs("string3", 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	res = serveAs(s, "DELETE", "/share/3", "")
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, http.StatusNoContent, res.Code)
+}
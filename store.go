@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	errMarkerNotFound = errors.New("Could not find marker")
+	errTripNotFound   = errors.New("Could not find trip")
+	errShareNotFound  = errors.New("Could not find share link")
+
+	errMemberNotFound     = errors.New("Could not find trip member")
+	errInvitationNotFound = errors.New("Could not find invitation")
+
+	errProfileNotFound = errors.New("Could not find profile")
+	errHandleTaken     = errors.New("Handle is already taken")
+)
+
+// MarkerStore is the persistence layer used by the handlers to keep the markers of every user
+type MarkerStore interface {
+	Insert(m *Marker) error
+	List(user string, filter MarkerFilter) (*MarkerCollection, error)
+	Near(user string, query NearQuery) (*MarkerCollection, error)
+	Get(user string, id int64) (*Marker, error)
+	// Update replaces a marker, an empty Visibility keeps the one it had
+	Update(m *Marker) error
+	// Delete and DeleteAt move markers to the trash of their user, every other method but Trash and Restore ignores them
+	Delete(user string, id int64) error
+	GetAt(user string, lat float64, lng float64) (*Marker, error)
+	DeleteAt(user string, lat float64, lng float64) error
+	// Trash lists the deleted markers of user, the most recently deleted first
+	Trash(user string) (*MarkerCollection, error)
+	// Restore takes a marker out of the trash
+	Restore(user string, id int64) (*Marker, error)
+	// Purge permanently removes the markers deleted before deletedBefore and returns how many there were
+	Purge(deletedBefore time.Time) (int64, error)
+	// History returns the revisions recorded on every change of a marker, trashed markers included
+	History(user string, id int64) (*MarkerHistory, error)
+	// Batch applies operations in a single transaction and returns the error of each one.
+	// In atomic mode it stops at the first failing operation and applies none of them,
+	// otherwise a failing operation is left out and the following ones still apply.
+	Batch(operations []BatchOperation, atomic bool) ([]error, error)
+	Ping() error
+	Close() error
+}
+
+// Kinds of BatchOperation
+const (
+	batchCreate = "create"
+	batchUpdate = "update"
+	batchDelete = "delete"
+)
+
+// BatchOperation is one change of a batch, Marker holds the owner and, except on create, the id of the marker
+type BatchOperation struct {
+	Kind   string
+	Marker *Marker
+}
+
+// TripStore keeps the trips of every user along with the ordered markers attached to them and their members.
+// Trashed markers are left out of their trips and covers until restored, purging a marker detaches it.
+// Trips are found by the user who created them, TripAccess tells which trips other users take part in.
+type TripStore interface {
+	InsertTrip(t *Trip) error
+	// ListTrips returns the trips user created or is a member of
+	ListTrips(user string) (*TripCollection, error)
+	GetTrip(user string, id int64) (*Trip, error)
+	// UpdateTrip replaces a trip, an empty Visibility keeps the one it had
+	UpdateTrip(t *Trip) error
+	DeleteTrip(user string, id int64) error
+	// TripMarkers returns the markers attached to a trip, in the trip order, whoever they belong to
+	TripMarkers(user string, id int64) ([]Marker, error)
+	// SetTripMarkers replaces the markers attached to a trip that editor can see,
+	// each of them must belong to editor unless it is already attached.
+	// The private markers of other members stay attached after them.
+	SetTripMarkers(user string, id int64, editor string, markerIDs []int64) error
+	// ImportTrips inserts imported markers and the trips holding them in a single transaction
+	ImportTrips(markers []Marker, trips []TripImport) error
+
+	// TripAccess returns the role of user on a trip, errTripNotFound when they do not take part in it
+	TripAccess(user string, id int64) (*TripAccess, error)
+	TripMembers(id int64) (*TripMembers, error)
+	// UpdateTripMember changes the role of a member, the creator of the trip is not one of them
+	UpdateTripMember(id int64, member TripMember) error
+	RemoveTripMember(id int64, user string) error
+	// InsertInvitation invites a user to a trip, replacing the invitation they may already have to it
+	InsertInvitation(inv *Invitation) error
+	// Invitations lists the pending invitations of user
+	Invitations(user string) (*InvitationCollection, error)
+	TripInvitations(id int64) (*InvitationCollection, error)
+	GetInvitation(id int64) (*Invitation, error)
+	// AcceptInvitation makes the invited user a member of the trip with the role of the invitation
+	AcceptInvitation(id int64) error
+	DeleteInvitation(id int64) error
+}
+
+// ShareStore keeps the share links of every user
+type ShareStore interface {
+	InsertShare(link *ShareLink) error
+	// ListShares returns the links of user that were neither revoked nor expired
+	ListShares(user string) (*ShareCollection, error)
+	RevokeShare(user string, id int64) error
+	// ShareByToken finds an active link by the hash of its token
+	ShareByToken(tokenHash string) (*ShareLink, error)
+}
+
+// ProfileStore keeps the public profiles of the users who chose a handle
+type ProfileStore interface {
+	// SetProfile creates or changes the profile of a user, errHandleTaken when another user has its handle
+	SetProfile(p *Profile) error
+	GetProfile(user string) (*Profile, error)
+	ProfileByHandle(handle string) (*Profile, error)
+	// PublicTrips lists the public trips created by user
+	PublicTrips(user string) ([]Trip, error)
+}
+
+// MarkerFilter narrows down the markers returned by MarkerStore.List, its zero value matches every marker.
+// Markers are listed by ascending id unless sorted otherwise, ties are broken by id
+// so a page never skips or repeats markers inserted meanwhile.
+type MarkerFilter struct {
+	Box *BoundingBox
+
+	// VisitedAfter and VisitedBefore only list markers visited in [VisitedAfter, VisitedBefore)
+	VisitedAfter  *time.Time
+	VisitedBefore *time.Time
+
+	Sort markerSort
+
+	// Visibility only lists markers with that visibility when set
+	Visibility string
+	// HidePrivate leaves out private markers, for listings handed out through share links
+	HidePrivate bool
+
+	// AsOf lists the markers as they were at that moment, from their revisions
+	AsOf *time.Time
+
+	// After only lists markers following the one of this cursor
+	After *markerCursor
+	// Limit is the size of a page, zero lists every marker
+	Limit int
+}
+
+func (f *MarkerFilter) matches(m *Marker) bool {
+	if f.Box != nil && !f.Box.contains(m.Lat, m.Lng) {
+		return false
+	}
+	if f.VisitedAfter != nil && (m.VisitedAt == nil || m.VisitedAt.Before(*f.VisitedAfter)) {
+		return false
+	}
+	if f.VisitedBefore != nil && (m.VisitedAt == nil || !m.VisitedAt.Before(*f.VisitedBefore)) {
+		return false
+	}
+	if f.Visibility != "" && m.Visibility != f.Visibility {
+		return false
+	}
+	if f.HidePrivate && m.Visibility == visibilityPrivate {
+		return false
+	}
+	if f.After != nil && !f.Sort.follows(m, f.After) {
+		return false
+	}
+	return true
+}
+
+// paginate trims markers, fetched with one extra row, to the filter limit and sets the next cursor
+func (f *MarkerFilter) paginate(collection *MarkerCollection) {
+	if f.Limit <= 0 || len(collection.Markers) <= f.Limit {
+		return
+	}
+
+	collection.Markers = collection.Markers[:f.Limit]
+	collection.NextCursor = f.Sort.cursor(&collection.Markers[f.Limit-1]).encode()
+}
+
+// Fields a marker listing can be sorted by
+const (
+	sortID        = "id"
+	sortCreatedAt = "created_at"
+	sortUpdatedAt = "updated_at"
+	sortVisitedAt = "visited_at"
+)
+
+// markerSort orders a listing by one field then by id, its zero value is the ascending id order
+type markerSort struct {
+	Field      string
+	Descending bool
+}
+
+var errInvalidSort = errors.New("sort must be id, created_at, updated_at or visited_at, prefixed by - to sort descending")
+
+// parseMarkerSort reads a sort query such as -visited_at
+func parseMarkerSort(raw string) (markerSort, error) {
+	order := markerSort{Field: strings.TrimPrefix(raw, "-"), Descending: strings.HasPrefix(raw, "-")}
+
+	switch order.Field {
+	case sortID, sortCreatedAt, sortUpdatedAt, sortVisitedAt:
+		return order, nil
+	}
+	return markerSort{}, errInvalidSort
+}
+
+func (o markerSort) byID() bool {
+	return o.Field == "" || o.Field == sortID
+}
+
+func (o markerSort) String() string {
+	field := o.Field
+	if field == "" {
+		field = sortID
+	}
+	if o.Descending {
+		return "-" + field
+	}
+	return field
+}
+
+// key is the sorted value of m, markers never visited sort as the earliest time
+func (o markerSort) key(m *Marker) time.Time {
+	switch o.Field {
+	case sortCreatedAt:
+		return m.CreatedAt
+	case sortUpdatedAt:
+		return m.UpdatedAt
+	case sortVisitedAt:
+		if m.VisitedAt != nil {
+			return *m.VisitedAt
+		}
+	}
+	return time.Time{}
+}
+
+// before tells whether a is listed before b
+func (o markerSort) before(a *Marker, b *Marker) bool {
+	if !o.byID() {
+		if keyA, keyB := o.key(a), o.key(b); !keyA.Equal(keyB) {
+			return keyA.Before(keyB) != o.Descending
+		}
+	}
+	return a.ID != b.ID && (a.ID < b.ID) != o.Descending
+}
+
+// follows tells whether m is listed after the marker of cursor
+func (o markerSort) follows(m *Marker, cursor *markerCursor) bool {
+	position := Marker{ID: cursor.ID}
+	if cursor.Key != nil {
+		position = Marker{ID: cursor.ID, CreatedAt: *cursor.Key, UpdatedAt: *cursor.Key, VisitedAt: cursor.Key}
+	}
+	return o.before(&position, m)
+}
+
+func (o markerSort) cursor(m *Marker) *markerCursor {
+	cursor := &markerCursor{ID: m.ID}
+	if o.String() != sortID {
+		cursor.Sort = o.String()
+	}
+	if !o.byID() {
+		key := o.key(m).UTC()
+		cursor.Key = &key
+	}
+	return cursor
+}
+
+// markerCursor is the position of the last marker of a page, handed to clients as an opaque token.
+// Sorted listings also keep the sort and the sorted value of that marker.
+type markerCursor struct {
+	ID   int64      `json:"id"`
+	Sort string     `json:"sort,omitempty"`
+	Key  *time.Time `json:"key,omitempty"`
+}
+
+var errInvalidCursor = errors.New("Invalid cursor")
+
+func (c *markerCursor) encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(token string) (*markerCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	var cursor markerCursor
+	if err = json.Unmarshal(raw, &cursor); err != nil || cursor.ID < 1 {
+		return nil, errInvalidCursor
+	}
+
+	if cursor.Sort == "" {
+		cursor.Sort = sortID
+	}
+	order, err := parseMarkerSort(cursor.Sort)
+	if err != nil || order.byID() != (cursor.Key == nil) {
+		return nil, errInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// NearQuery looks for the markers closest to a point, sorted by great-circle distance.
+// A zero Radius or Limit means no bound on the distance or on the number of markers.
+type NearQuery struct {
+	Lat    float64
+	Lng    float64
+	Radius float64
+	Limit  int
+}
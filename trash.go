@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+func (s *server) handleGetTrash() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		markers, err := s.store.Trash(userZid)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find markers")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, markers)
+	}
+}
+
+func (s *server) handleRestoreMarker() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userZid := principalFrom(r.Context()).ZID
+
+		id, err := getMarkerID(mux.Vars(r))
+		if err != nil {
+			s.writeProblem(w, r, problemNotFound, "Could not find marker in the trash", err)
+			return
+		}
+
+		marker, err := s.store.Restore(userZid, id)
+		if err != nil {
+			s.writeStoreError(w, r, err, "Could not find marker in the trash")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, marker)
+	}
+}
+
+// PurgeResult tells how many markers an on demand purge of the trash removed
+type PurgeResult struct {
+	Purged int64 `json:"purged"`
+}
+
+// handlePurgeTrash lets admins purge the trash of every user right away, without waiting for the next interval
+func (s *server) handlePurgeTrash() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		purged, err := s.purger.purge(time.Now())
+		if err != nil {
+			s.writeStoreError(w, r, err, "")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, PurgeResult{Purged: purged})
+	}
+}
+
+// Defaults of TRASH_RETENTION and TRASH_PURGE_INTERVAL
+const (
+	defaultTrashRetention     = 30 * 24 * time.Hour
+	defaultTrashPurgeInterval = time.Hour
+)
+
+// trashPurger permanently removes in the background the markers kept in the trash for longer than retention
+type trashPurger struct {
+	store     MarkerStore
+	retention time.Duration
+	interval  time.Duration
+	logger    *zap.Logger
+
+	stop chan struct{}
+}
+
+// newTrashPurger reads the retention and how often to purge from TRASH_RETENTION and TRASH_PURGE_INTERVAL
+func newTrashPurger(store MarkerStore, logger *zap.Logger) (*trashPurger, error) {
+	p := &trashPurger{
+		store:     store,
+		retention: defaultTrashRetention,
+		interval:  defaultTrashPurgeInterval,
+		logger:    logger,
+		stop:      make(chan struct{}),
+	}
+
+	for name, setting := range map[string]*time.Duration{"TRASH_RETENTION": &p.retention, "TRASH_PURGE_INTERVAL": &p.interval} {
+		if raw, ok := os.LookupEnv(name); ok {
+			duration, err := time.ParseDuration(raw)
+			if err != nil || duration <= 0 {
+				return nil, fmt.Errorf("invalid %s %q", name, raw)
+			}
+			*setting = duration
+		}
+	}
+
+	return p, nil
+}
+
+// start purges right away, then every interval until Close
+func (p *trashPurger) start() {
+	p.logger.Info("Purging the trash", zap.Duration("retention", p.retention), zap.Duration("interval", p.interval))
+	go p.run()
+}
+
+// Close stops the background purge
+func (p *trashPurger) Close() error {
+	close(p.stop)
+	return nil
+}
+
+func (p *trashPurger) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	p.purge(time.Now())
+	for {
+		select {
+		case now := <-ticker.C:
+			p.purge(now)
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// purge removes the markers deleted more than retention before now and returns how many there were
+func (p *trashPurger) purge(now time.Time) (int64, error) {
+	purged, err := p.store.Purge(now.Add(-p.retention))
+	if err != nil {
+		p.logger.Error("Could not purge the trash", zap.Error(err))
+		return 0, err
+	}
+	if purged > 0 {
+		p.logger.Info("Purged the trash", zap.Int64("markers", purged))
+	}
+	return purged, nil
+}
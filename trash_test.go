@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestMemoryTrashAndRestore(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	s.store.Insert(&Marker{User: "string3", Lat: 48.85, Lng: 2.35, Note: "paris"})
+	s.store.Insert(&Marker{User: "string3", Lat: 45.76, Lng: 4.83, Note: "lyon"})
+	s.store.Insert(&Marker{User: "someone-else", Lat: 1, Lng: 1})
+	s.trips.InsertTrip(&Trip{User: "string3", Name: "France"})
+	s.trips.SetTripMarkers("string3", 1, "string3", []int64{1, 2})
+
+	res := serveAs(s, "DELETE", "/marker/1", "")
+	assert.Equal(t, http.StatusNoContent, res.Code)
+
+	res = serveAs(s, "GET", "/marker", "")
+	assert.Equal(t, `{"markers":[{"id":2,"user":"string3","lat":45.76,"lng":4.83,"note":"lyon","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}]}`, res.Body.String())
+
+	res = serveAs(s, "GET", "/marker/1", "")
+	assertProblem(t, res, problemNotFound)
+
+	markers, _ := s.trips.TripMarkers("string3", 1)
+	assert.Len(t, markers, 1)
+
+	res = serveAs(s, "GET", "/trash", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"markers":[{"id":1,"user":"string3","lat":48.85,"lng":2.35,"note":"paris","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z","deleted_at":"2019-03-10T20:33:20Z"}]}`, res.Body.String())
+
+	res = serveAs(s, "POST", "/trash/2/restore", "")
+	assertProblem(t, res, problemNotFound)
+	res = serveAs(s, "POST", "/trash/3/restore", "")
+	assertProblem(t, res, problemNotFound)
+
+	res = serveAs(s, "POST", "/trash/1/restore", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"id":1,"user":"string3","lat":48.85,"lng":2.35,"note":"paris","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}`, res.Body.String())
+
+	res = serveAs(s, "GET", "/trash", "")
+	assert.Equal(t, `{"markers":null}`, res.Body.String())
+
+	markers, _ = s.trips.TripMarkers("string3", 1)
+	assert.Len(t, markers, 2)
+}
+
+func TestMemoryPurgeTrash(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	store := s.store.(*memoryStore)
+	cover := int64(1)
+	s.store.Insert(&Marker{User: "string3", Lat: 1, Lng: 1})
+	s.store.Insert(&Marker{User: "string3", Lat: 2, Lng: 2})
+	s.trips.InsertTrip(&Trip{User: "string3", Name: "France", CoverMarkerID: &cover})
+	s.trips.SetTripMarkers("string3", 1, "string3", []int64{1, 2})
+
+	s.store.Delete("string3", 1)
+	store.now = func() time.Time { return stubMarkerTime.Add(time.Hour) }
+	s.store.Delete("string3", 2)
+
+	purged, err := s.store.Purge(stubMarkerTime.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+
+	_, err = s.store.Restore("string3", 1)
+	assert.Equal(t, errMarkerNotFound, err)
+	_, err = s.store.Restore("string3", 2)
+	assert.NoError(t, err)
+
+	trip, _ := s.trips.GetTrip("string3", 1)
+	assert.Nil(t, trip.CoverMarkerID)
+	markers, _ := s.trips.TripMarkers("string3", 1)
+	assert.Equal(t, []int64{2}, []int64{markers[0].ID})
+}
+
+func TestTrashQueries(t *testing.T) {
+	s, mock := getMockServer()
+	defer s.finalize()
+
+	deletedAt := stubMarkerTime.Add(time.Hour)
+	mock.ExpectQuery(`WHERE username=\$1\s+AND deleted_at IS NOT NULL\s+ORDER BY deleted_at DESC, id`).
+		WithArgs("string3").
+		WillReturnRows(markerRows("deleted_at").
+			AddRow(4, "string3", 1.5, 1.5, "", "members", stubMarkerTime, stubMarkerTime, nil, nil, deletedAt))
+
+	res := serveAs(s, "GET", "/trash", "")
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, `{"markers":[{"id":4,"user":"string3","lat":1.5,"lng":1.5,"note":"","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z","deleted_at":"2019-03-10T21:33:20Z"}]}`, res.Body.String())
+
+	mock.ExpectQuery(`SET deleted_at=NULL, changed_by=username\s+WHERE username=\$1\s+AND id=\$2\s+AND deleted_at IS NOT NULL`).
+		WithArgs("string3", 4).
+		WillReturnRows(markerRows().
+			AddRow(4, "string3", 1.5, 1.5, "", "members", stubMarkerTime, stubMarkerTime, nil, nil))
+
+	res = serveAs(s, "POST", "/trash/4/restore", "")
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	mock.ExpectQuery(`SET deleted_at=NULL`).
+		WithArgs("string3", 5).
+		WillReturnRows(markerRows())
+
+	res = serveAs(s, "POST", "/trash/5/restore", "")
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assertProblem(t, res, problemNotFound)
+
+	mock.ExpectExec(`DELETE FROM markers\s+WHERE deleted_at < \$1`).
+		WithArgs(deletedAt).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	purged, err := s.store.Purge(deletedAt)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), purged)
+}
+
+func TestNewTrashPurger(t *testing.T) {
+	logger := zap.NewNop()
+
+	os.Unsetenv("TRASH_RETENTION")
+	os.Setenv("TRASH_PURGE_INTERVAL", "10m")
+	defer os.Unsetenv("TRASH_PURGE_INTERVAL")
+
+	p, err := newTrashPurger(newMemoryStore(), logger)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultTrashRetention, p.retention)
+	assert.Equal(t, 10*time.Minute, p.interval)
+
+	for _, invalid := range []string{"a week", "0s", "-1h"} {
+		os.Setenv("TRASH_RETENTION", invalid)
+		_, err = newTrashPurger(newMemoryStore(), logger)
+		assert.Error(t, err, invalid)
+	}
+	os.Unsetenv("TRASH_RETENTION")
+}
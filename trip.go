@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// TripCollection represents the trips a user created or is a member of
+type TripCollection struct {
+	Trips []Trip `json:"trips"`
+}
+
+// Trip is a named journey grouping markers in the order they were visited.
+// User is who created the trip, other users take part in it as members.
+type Trip struct {
+	ID          int64  `json:"id"`
+	User        string `json:"user,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	// Visibility tells who besides its creator can see the trip, private trips are hidden from their members
+	Visibility string `json:"visibility"`
+
+	// StartDate and EndDate are calendar days formatted as YYYY-MM-DD, empty when unknown
+	StartDate string `json:"start_date,omitempty"`
+	EndDate   string `json:"end_date,omitempty"`
+
+	// CoverMarkerID is the marker pictured for the trip, it must belong to the same user
+	CoverMarkerID *int64 `json:"cover_marker_id,omitempty"`
+}
+
+// TripWithMarkers is a trip along with its markers, in the trip order
+type TripWithMarkers struct {
+	Trip
+	Markers []Marker `json:"markers"`
+}
+
+// Roles of the members of a trip, the user who created a trip is always one of its owners
+const (
+	roleOwner  = "owner"
+	roleEditor = "editor"
+	roleViewer = "viewer"
+)
+
+// tripRoles ranks the roles, each one may do everything the lower ones may: viewers read the trip,
+// editors also change its markers and owners also change the trip itself and manage its members
+var tripRoles = map[string]int{roleViewer: 1, roleEditor: 2, roleOwner: 3}
+
+var errTripRole = errors.New("Role on trip does not allow this")
+
+// TripAccess is what a user may do on a trip, Creator owns the trip data
+type TripAccess struct {
+	Creator string
+	Role    string
+}
+
+func (a *TripAccess) allows(role string) bool {
+	return tripRoles[a.Role] >= tripRoles[role]
+}
+
+// TripImport is a trip created along with imported markers, Markers are their positions in the import
+type TripImport struct {
+	Trip    Trip
+	Markers []int
+}
+
+// TripMembers lists the users taking part in a trip, its creator first
+type TripMembers struct {
+	Members []TripMember `json:"members"`
+}
+
+// TripMember is a user taking part in a trip along with their role
+type TripMember struct {
+	User string `json:"zid"`
+	Role string `json:"role"`
+}
+
+// InvitationCollection represents pending invitations, either of a user or to a trip
+type InvitationCollection struct {
+	Invitations []Invitation `json:"invitations"`
+}
+
+// Invitation asks a user to join a trip with a role, it is pending until they accept or decline it
+type Invitation struct {
+	ID        int64     `json:"id"`
+	TripID    int64     `json:"trip_id"`
+	User      string    `json:"zid"`
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invited_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
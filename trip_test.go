@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveAs sends a request authenticated with the stub token
+func serveAs(s *server, method string, url string, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Authorization", stubAuthHeader)
+	res := httptest.NewRecorder()
+	s.router.ServeHTTP(res, req)
+	return res
+}
+
+// expectTripAccess expects the lookup of the role of user on a trip created by creator
+func expectTripAccess(mock sqlmock.Sqlmock, user string, id int64, creator string, role string) {
+	mock.ExpectQuery(`LEFT JOIN trip_members ON trip_members.trip_id = trips.id AND trip_members.username=\$1\s+WHERE trips.id=\$2`).
+		WithArgs(user, id).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "role"}).AddRow(creator, role))
+}
+
+func TestMemoryTripLifecycle(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	s.store.Insert(&Marker{User: "string3", Lat: 48.85, Lng: 2.35, Note: "paris"})
+	s.store.Insert(&Marker{User: "string3", Lat: 45.76, Lng: 4.83, Note: "lyon"})
+	s.store.Insert(&Marker{User: "someone-else", Lat: 1, Lng: 1})
+
+	res := serveAs(s, "PUT", "/trip", `{"name":"France","start_date":"2019-03-01","end_date":"2019-03-10","cover_marker_id":1}`)
+	assert.Equal(t, http.StatusCreated, res.Code)
+	assert.Equal(t, `{"id":1,"user":"string3","name":"France","description":"","visibility":"members","start_date":"2019-03-01","end_date":"2019-03-10","cover_marker_id":1}`, res.Body.String())
+
+	res = serveAs(s, "PUT", "/trip/1/markers", `{"marker_ids":[2,1]}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"id":1,"user":"string3","name":"France","description":"","visibility":"members","start_date":"2019-03-01","end_date":"2019-03-10","cover_marker_id":1,"markers":[{"id":2,"user":"string3","lat":45.76,"lng":4.83,"note":"lyon","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"},{"id":1,"user":"string3","lat":48.85,"lng":2.35,"note":"paris","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}]}`, res.Body.String())
+
+	res = serveAs(s, "PUT", "/trip/1", `{"name":"France","description":"by train","cover_marker_id":1}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	res = serveAs(s, "DELETE", "/marker/1", "")
+	assert.Equal(t, http.StatusNoContent, res.Code)
+
+	res = serveAs(s, "GET", "/trip/1", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"id":1,"user":"string3","name":"France","description":"by train","visibility":"members","markers":[{"id":2,"user":"string3","lat":45.76,"lng":4.83,"note":"lyon","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}]}`, res.Body.String())
+
+	res = serveAs(s, "GET", "/trip", "")
+	assert.Equal(t, `{"trips":[{"id":1,"user":"string3","name":"France","description":"by train","visibility":"members"}]}`, res.Body.String())
+
+	res = serveAs(s, "DELETE", "/trip/1", "")
+	assert.Equal(t, http.StatusNoContent, res.Code)
+
+	res = serveAs(s, "GET", "/trip/1", "")
+	assertProblem(t, res, problemNotFound)
+}
+
+func TestMemoryTripValidation(t *testing.T) {
+	s := getMemoryServer()
+	defer s.finalize()
+
+	s.store.Insert(&Marker{User: "string3", Lat: 1, Lng: 1})
+	s.store.Insert(&Marker{User: "someone-else", Lat: 1, Lng: 1})
+	s.trips.InsertTrip(&Trip{User: "string3", Name: "mine"})
+	s.trips.InsertTrip(&Trip{User: "someone-else", Name: "theirs"})
+
+	requests := []struct {
+		method string
+		url    string
+		body   string
+		kind   problemType
+		errors []fieldError
+	}{
+		{"PUT", "/trip", `{}`, problemValidation, []fieldError{{"name", "is required"}}},
+		{"PUT", "/trip", `{"name":" ","start_date":"01/03/2019"}`, problemValidation, []fieldError{{"name", "must not be blank"}, {"start_date", "must be a date formatted as YYYY-MM-DD"}}},
+		{"PUT", "/trip", `{"name":"a","start_date":"2019-03-10","end_date":"2019-03-01"}`, problemValidation, []fieldError{{"end_date", "must not be before start_date"}}},
+		{"PUT", "/trip", `{"name":"a","cover_marker_id":2}`, problemValidation, []fieldError{{"cover_marker_id", "must be one of your markers"}}},
+		{"PUT", "/trip/1/markers", `{"marker_ids":[1,2]}`, problemValidation, []fieldError{{"marker_ids", "must only contain your markers"}}},
+		{"PUT", "/trip/1/markers", `{"marker_ids":[1,1]}`, problemValidation, []fieldError{{"marker_ids", "lists marker 1 more than once"}}},
+		{"PUT", "/trip/1/markers", `{"marker_ids":"1"}`, problemValidation, []fieldError{{"marker_ids", "must be a list of marker ids"}}},
+		{"PUT", "/trip/2/markers", `{"marker_ids":[1]}`, problemNotFound, nil},
+		{"PUT", "/trip/2", `{"name":"stolen"}`, problemNotFound, nil},
+		{"DELETE", "/trip/2", ``, problemNotFound, nil},
+	}
+
+	for _, tt := range requests {
+		res := serveAs(s, tt.method, tt.url, tt.body)
+		assertProblem(t, res, tt.kind, tt.errors...)
+	}
+}
+
+func TestGetTripWithMarkers(t *testing.T) {
+	s, mock := getMockServer()
+	defer s.finalize()
+
+	expectTripAccess(mock, "string3", 7, "string3", roleOwner)
+	mock.ExpectQuery(`FROM trips\s+WHERE username=\$1\s+AND id=\$2`).
+		WithArgs("string3", 7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "description", "visibility", "start_date", "end_date", "cover_marker_id"}).
+			AddRow(7, "string3", "France", "", "members", "2019-03-01", "", nil))
+	mock.ExpectQuery(`FROM trips\s+WHERE username=\$1\s+AND id=\$2`).
+		WithArgs("string3", 7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "description", "visibility", "start_date", "end_date", "cover_marker_id"}).
+			AddRow(7, "string3", "France", "", "members", "2019-03-01", "", nil))
+	mock.ExpectQuery(`JOIN markers ON markers.id = trip_markers.marker_id\s+WHERE trip_markers.trip_id=\$1\s+AND markers.deleted_at IS NULL\s+ORDER BY trip_markers.position`).
+		WithArgs(7).
+		WillReturnRows(markerRows().
+			AddRow(2, "string3", 45.76, 4.83, "lyon", "members", stubMarkerTime, stubMarkerTime, nil, nil).
+			AddRow(1, "string3", 48.85, 2.35, "paris", "members", stubMarkerTime, stubMarkerTime, nil, nil))
+
+	res := serveAs(s, "GET", "/trip/7", "")
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"id":7,"user":"string3","name":"France","description":"","visibility":"members","start_date":"2019-03-01","markers":[{"id":2,"user":"string3","lat":45.76,"lng":4.83,"note":"lyon","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"},{"id":1,"user":"string3","lat":48.85,"lng":2.35,"note":"paris","visibility":"members","created_at":"2019-03-10T20:33:20Z","updated_at":"2019-03-10T20:33:20Z"}]}`, res.Body.String())
+}
+
+func TestSetTripMarkersWithForeignMarker(t *testing.T) {
+	s, mock := getMockServer()
+	defer s.finalize()
+
+	expectTripAccess(mock, "string3", 7, "string3", roleOwner)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id FROM trips`).
+		WithArgs("string3", 7).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectQuery(`SELECT count\(\*\) FROM markers`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectRollback()
+
+	res := serveAs(s, "PUT", "/trip/7/markers", `{"marker_ids":[1,2]}`)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assertProblem(t, res, problemValidation, fieldError{"marker_ids", "must only contain your markers"})
+}
+
+func TestSetTripMarkersKeepsHiddenMarkers(t *testing.T) {
+	s, mock := getMockServer()
+	defer s.finalize()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id FROM trips`).
+		WithArgs("someone-else", 7).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectQuery(`SELECT count\(\*\) FROM markers`).
+		WithArgs("string3", sqlmock.AnyArg(), 7).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectExec(`DELETE FROM trip_markers\s+WHERE trip_id=\$1\s+AND marker_id NOT IN \(SELECT id FROM markers WHERE username<>\$2 AND visibility='private'\)`).
+		WithArgs(7, "string3").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`UPDATE trip_markers SET position=position\+\$2 WHERE trip_id=\$1`).
+		WithArgs(7, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO trip_markers \(trip_id, marker_id, position\)`).
+		WithArgs(7, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	assert.NoError(t, s.trips.SetTripMarkers("someone-else", 7, "string3", []int64{3, 1}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
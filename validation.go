@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fieldError tells which field of a request failed validation and why
+type fieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// validationError gathers every field of a request that failed validation
+type validationError struct {
+	Fields []fieldError
+}
+
+func (e *validationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		messages[i] = f.Field + " " + f.Reason
+	}
+	return "Invalid fields: " + strings.Join(messages, ", ")
+}
+
+func (e *validationError) add(field string, reason string) {
+	e.Fields = append(e.Fields, fieldError{Field: field, Reason: reason})
+}
+
+// orNil returns the error only when some field failed, so it can be returned as an error directly
+func (e *validationError) orNil() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// validateMarker checks the coordinates of a marker that is about to be saved
+func validateMarker(marker *Marker) error {
+	errs := &validationError{}
+
+	if reason := latitudeProblem(marker.Lat); reason != "" {
+		errs.add("lat", reason)
+	}
+	if reason := longitudeProblem(marker.Lng); reason != "" {
+		errs.add("lng", reason)
+	}
+
+	return errs.orNil()
+}
+
+func latitudeProblem(lat float64) string {
+	if math.IsNaN(lat) || math.IsInf(lat, 0) {
+		return "must be a finite number"
+	}
+	if lat < -90 || lat > 90 {
+		return "must be between -90 and 90"
+	}
+	return ""
+}
+
+func longitudeProblem(lng float64) string {
+	if math.IsNaN(lng) || math.IsInf(lng, 0) {
+		return "must be a finite number"
+	}
+	if lng < -180 || lng > 180 {
+		return "must be between -180 and 180"
+	}
+	return ""
+}
+
+// setMarkerField parses one JSON field of a request body into marker, reporting a bad value in errs
+func setMarkerField(marker *Marker, field string, value json.RawMessage, errs *validationError) {
+	switch field {
+	case "lat":
+		lat, reason := parseJSONNumber(value)
+		if reason == "" {
+			reason = latitudeProblem(lat)
+		}
+		if reason != "" {
+			errs.add(field, reason)
+			return
+		}
+		marker.Lat = lat
+	case "lng":
+		lng, reason := parseJSONNumber(value)
+		if reason == "" {
+			reason = longitudeProblem(lng)
+		}
+		if reason != "" {
+			errs.add(field, reason)
+			return
+		}
+		marker.Lng = lng
+	case "note":
+		if err := json.Unmarshal(value, &marker.Note); err != nil {
+			errs.add(field, "must be a string")
+		}
+	case "visited_at":
+		var visitedAt time.Time
+		if err := json.Unmarshal(value, &visitedAt); err != nil {
+			errs.add(field, "must be a RFC 3339 time with its offset")
+			return
+		}
+		marker.VisitedAt = &visitedAt
+	case "visibility":
+		if err := json.Unmarshal(value, &marker.Visibility); err != nil || !visibilities[marker.Visibility] {
+			errs.add(field, "must be one of private, members and public")
+		}
+	}
+}
+
+// dateLayout is the format of the calendar days of a trip
+const dateLayout = "2006-01-02"
+
+// setTripField parses one JSON field of a request body into trip, reporting a bad value in errs.
+// A null value clears the optional fields.
+func setTripField(trip *Trip, field string, value json.RawMessage, errs *validationError) {
+	switch field {
+	case "name":
+		if err := json.Unmarshal(value, &trip.Name); err != nil || isJSONNull(value) {
+			errs.add(field, "must be a string")
+			return
+		}
+		if strings.TrimSpace(trip.Name) == "" {
+			errs.add(field, "must not be blank")
+		}
+	case "description":
+		trip.Description = ""
+		if err := json.Unmarshal(value, &trip.Description); err != nil {
+			errs.add(field, "must be a string")
+		}
+	case "visibility":
+		trip.Visibility = ""
+		if err := json.Unmarshal(value, &trip.Visibility); err != nil || (trip.Visibility != "" && !visibilities[trip.Visibility]) {
+			errs.add(field, "must be one of private, members and public")
+		}
+	case "start_date", "end_date":
+		var date string
+		if err := json.Unmarshal(value, &date); err != nil {
+			errs.add(field, "must be a date formatted as YYYY-MM-DD")
+			return
+		}
+		if _, err := time.Parse(dateLayout, date); date != "" && err != nil {
+			errs.add(field, "must be a date formatted as YYYY-MM-DD")
+			return
+		}
+		if field == "start_date" {
+			trip.StartDate = date
+		} else {
+			trip.EndDate = date
+		}
+	case "cover_marker_id":
+		trip.CoverMarkerID = nil
+		if isJSONNull(value) {
+			return
+		}
+		var id int64
+		if err := json.Unmarshal(value, &id); err != nil || id < 1 {
+			errs.add(field, "must be a marker id")
+			return
+		}
+		trip.CoverMarkerID = &id
+	}
+}
+
+// validateTripDates checks the date range of a trip once both ends are known
+func validateTripDates(trip *Trip, errs *validationError) {
+	if trip.StartDate != "" && trip.EndDate != "" && trip.EndDate < trip.StartDate {
+		errs.add("end_date", "must not be before start_date")
+	}
+}
+
+// parseJSONNumber reads a JSON number literal.
+// Numbers too large for a float64 become infinities so they are reported as not finite.
+func parseJSONNumber(value json.RawMessage) (float64, string) {
+	raw := string(bytes.TrimSpace(value))
+	if raw == "" || (raw[0] != '-' && (raw[0] < '0' || raw[0] > '9')) {
+		return 0, "must be a number"
+	}
+
+	number, err := strconv.ParseFloat(raw, 64)
+	if err != nil && !math.IsInf(number, 0) {
+		return 0, "must be a number"
+	}
+	return number, ""
+}
+
+func isJSONNull(value json.RawMessage) bool {
+	return string(bytes.TrimSpace(value)) == "null"
+}